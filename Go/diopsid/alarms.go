@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/spf13/viper"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/authentication"
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Metrics that can have thresholds
+const (
+	metricUsedFraction  = "used-fraction"
+	metricFreeBytes     = "free-bytes"
+	metricInodeFraction = "inode-fraction"
+	metricHoursToFull   = "hours-to-full"
+)
+
+type alarmLevel int
+
+const (
+	alarmOK alarmLevel = iota
+	alarmWarning
+	alarmCritical
+)
+
+func (level alarmLevel) String() string {
+	switch level {
+	case alarmWarning:
+		return "warning"
+	case alarmCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// thresholdConfig is the configuration form of an alarm; if Dir is empty, it applies to every directory.
+// A level that isn't given is disabled.
+type thresholdConfig struct {
+	Dir        string   `mapstructure:"dir"`
+	Metric     string   `mapstructure:"metric"`
+	Warning    *float64 `mapstructure:"warning"`
+	Critical   *float64 `mapstructure:"critical"`
+	Hysteresis float64  `mapstructure:"hysteresis"`
+}
+
+// alarm tracks the state of one metric of one directory.
+// The state goes up as soon as a threshold is crossed, but only comes back down once the value is clear of
+// the threshold by more than the hysteresis, so that a value hovering around a threshold doesn't flap.
+type alarm struct {
+	dir    string
+	metric string
+	// each level only applies if it was configured
+	warning     float64
+	hasWarning  bool
+	critical    float64
+	hasCritical bool
+	hysteresis  float64
+
+	level        alarmLevel
+	lastNotified time.Time
+}
+
+// lowIsBad is true for metrics where small values are the problem
+func lowIsBad(metric string) bool {
+	return metric == metricFreeBytes || metric == metricHoursToFull
+}
+
+func metricValue(metric string, disk DiskStatus) float64 {
+	switch metric {
+	case metricUsedFraction:
+		return disk.Fraction
+	case metricFreeBytes:
+		return float64(disk.Avail)
+	case metricInodeFraction:
+		return disk.InodesFraction
+	case metricHoursToFull:
+		return disk.HoursToFull
+	}
+	return 0
+}
+
+// loadAlarms reads the "thresholds" configuration, and makes an alarm for each directory each threshold applies to
+func loadAlarms(dirs []string) (alarms map[string][]*alarm, e error) {
+	alarms = make(map[string][]*alarm)
+	isDir := make(map[string]bool)
+	for _, dir := range dirs {
+		isDir[dir] = true
+	}
+
+	var configs []thresholdConfig
+	if e = viper.UnmarshalKey("thresholds", &configs); e != nil {
+		return
+	}
+	for _, config := range configs {
+		switch config.Metric {
+		case metricUsedFraction, metricFreeBytes, metricInodeFraction, metricHoursToFull:
+		default:
+			e = fmt.Errorf("Unknown threshold metric <%s>; options are \"%s\", \"%s\", \"%s\" and \"%s\"", config.Metric, metricUsedFraction, metricFreeBytes, metricInodeFraction, metricHoursToFull)
+			return
+		}
+		if config.Warning == nil && config.Critical == nil {
+			e = fmt.Errorf("The %s threshold for <%s> has neither a warning nor a critical level", config.Metric, config.Dir)
+			return
+		}
+		if config.Warning != nil && config.Critical != nil &&
+			((lowIsBad(config.Metric) && *config.Critical > *config.Warning) || (!lowIsBad(config.Metric) && *config.Critical < *config.Warning)) {
+			e = fmt.Errorf("The %s critical threshold for <%s> is less severe than the warning threshold", config.Metric, config.Dir)
+			return
+		}
+		if config.Hysteresis < 0 {
+			e = fmt.Errorf("The %s hysteresis for <%s> is negative", config.Metric, config.Dir)
+			return
+		}
+
+		appliesTo := dirs
+		if config.Dir != "" {
+			dir := strings.TrimSuffix(config.Dir, "/")
+			if !isDir[dir] {
+				e = fmt.Errorf("Threshold directory <%s> is not one of the directories being monitored", config.Dir)
+				return
+			}
+			appliesTo = []string{dir}
+		}
+		for _, dir := range appliesTo {
+			newAlarm := &alarm{
+				dir:        dir,
+				metric:     config.Metric,
+				hysteresis: config.Hysteresis,
+			}
+			if config.Warning != nil {
+				newAlarm.warning, newAlarm.hasWarning = *config.Warning, true
+			}
+			if config.Critical != nil {
+				newAlarm.critical, newAlarm.hasCritical = *config.Critical, true
+			}
+			alarms[dir] = append(alarms[dir], newAlarm)
+			logging.Log.Noticef("Alarm for <%s>: %s warning at %s, critical at %s", dir, config.Metric, newAlarm.levelString(alarmWarning), newAlarm.levelString(alarmCritical))
+		}
+	}
+
+	// "fill-horizon" is a shortcut for a hours-to-full warning on every directory
+	if horizon := viper.GetDuration("fill-horizon"); horizon > 0 {
+		for _, dir := range dirs {
+			alarms[dir] = append(alarms[dir], &alarm{
+				dir:        dir,
+				metric:     metricHoursToFull,
+				warning:    horizon.Hours(),
+				hasWarning: true,
+				hysteresis: viper.GetDuration("fill-horizon-hysteresis").Hours(),
+			})
+		}
+		logging.Log.Noticef("Alarm for all directories: predicted to fill up within %v", horizon)
+	}
+	return
+}
+
+// levelString describes a threshold for logging
+func (a *alarm) levelString(level alarmLevel) string {
+	switch {
+	case level == alarmWarning && a.hasWarning:
+		return fmt.Sprint(a.warning)
+	case level == alarmCritical && a.hasCritical:
+		return fmt.Sprint(a.critical)
+	}
+	return "(disabled)"
+}
+
+// sameThresholds checks whether two alarms are for the same metric with the same levels
+func (a *alarm) sameThresholds(other *alarm) bool {
+	return a.metric == other.metric &&
+		a.hasWarning == other.hasWarning && a.warning == other.warning &&
+		a.hasCritical == other.hasCritical && a.critical == other.critical
+}
+
+// evaluate returns the alarm level for a new value, taking the current level into account
+func (a *alarm) evaluate(value float64) alarmLevel {
+	// flip the sign for metrics where low is bad, so that higher is always worse
+	warning, critical, current := a.warning, a.critical, value
+	if lowIsBad(a.metric) {
+		warning, critical, current = -warning, -critical, -current
+	}
+	switch {
+	case a.hasCritical && current >= critical:
+		return alarmCritical
+	case a.hasCritical && a.level == alarmCritical && current > critical-a.hysteresis:
+		return alarmCritical
+	case a.hasWarning && current >= warning:
+		return alarmWarning
+	case a.hasWarning && a.level >= alarmWarning && current > warning-a.hysteresis:
+		return alarmWarning
+	}
+	return alarmOK
+}
+
+// alarmNotifier sends alarm alerts, and optionally Slack messages, when an alarm changes state,
+// and again every renotifyInterval while an alarm is raised
+type alarmNotifier struct {
+	service          *dripline.AmqpService
+	renotifyInterval time.Duration
+	slackAPI         *slack.Client
+	slackChannel     string
+}
+
+// newAlarmNotifier reads the alarm notification configuration; Slack messages are sent if "slack-channel" is set
+func newAlarmNotifier(service *dripline.AmqpService) (n *alarmNotifier, e error) {
+	n = &alarmNotifier{
+		service:          service,
+		renotifyInterval: viper.GetDuration("renotify-interval"),
+		slackChannel:     viper.GetString("slack-channel"),
+	}
+	if n.slackChannel == "" {
+		return
+	}
+	slackUser := viper.GetString("slack-username")
+	if !authentication.SlackAvailable(slackUser) {
+		e = fmt.Errorf("Slack authentication for user <%s> is not available", slackUser)
+		return
+	}
+	n.slackAPI = slack.New(authentication.SlackToken(slackUser))
+	if n.slackAPI == nil {
+		e = fmt.Errorf("Unable to make a new Slack API")
+		return
+	}
+	logging.Log.Noticef("Alarms will be posted to Slack channel <%s>", n.slackChannel)
+	return
+}
+
+// check evaluates a directory's alarms against a new reading
+func (n *alarmNotifier) check(alarms []*alarm, routingKey string, disk DiskStatus) {
+	for _, a := range alarms {
+		value := metricValue(a.metric, disk)
+		previous := a.level
+		a.level = a.evaluate(value)
+
+		switch {
+		case a.level != previous:
+			if a.level > previous {
+				logging.Log.Warningf("Alarm for <%s>: %s is %s (%v)", a.dir, a.metric, a.level, value)
+			} else {
+				logging.Log.Noticef("Alarm for <%s>: %s is back to %s (%v)", a.dir, a.metric, a.level, value)
+			}
+			n.notify(a, previous, value, routingKey)
+		case a.level != alarmOK && n.renotifyInterval > 0 && time.Since(a.lastNotified) >= n.renotifyInterval:
+			logging.Log.Warningf("Alarm for <%s>: %s is still %s (%v)", a.dir, a.metric, a.level, value)
+			n.notify(a, previous, value, routingKey)
+		}
+	}
+}
+
+func (n *alarmNotifier) notify(a *alarm, previous alarmLevel, value float64, routingKey string) {
+	a.lastNotified = time.Now()
+
+	var message string
+	if a.level == previous {
+		message = fmt.Sprintf("%s: %s on %s is still %s (%v)", MasterSenderInfo.Hostname, a.metric, a.dir, a.level, value)
+	} else {
+		message = fmt.Sprintf("%s: %s on %s changed from %s to %s (%v)", MasterSenderInfo.Hostname, a.metric, a.dir, previous, a.level, value)
+	}
+
+	alert := dripline.PrepareAlert(routingKey, "application/json", MasterSenderInfo)
+	var payload map[string]interface{}
+	payload = make(map[string]interface{})
+	payload["dir"] = a.dir
+	payload["metric"] = a.metric
+	payload["state"] = a.level.String()
+	payload["previous_state"] = previous.String()
+	// JSON has no infinity (e.g. the time to full of a disk that isn't filling up)
+	if !math.IsInf(value, 0) {
+		payload["value"] = value
+	}
+	if a.hasWarning {
+		payload["warning"] = a.warning
+	}
+	if a.hasCritical {
+		payload["critical"] = a.critical
+	}
+	payload["message"] = message
+	alert.Message.Payload = payload
+	if e := sendAlert(n.service, alert); e != nil {
+		logging.Log.Errorf("Could not send the alarm alert: %v", e)
+	}
+
+	if n.slackAPI != nil {
+		if _, _, slackErr := n.slackAPI.PostMessage(n.slackChannel, slack.MsgOptionText(message, false)); slackErr != nil {
+			logging.Log.Errorf("Could not post the alarm to Slack: %v", slackErr)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAlarmUnsetLevel(t *testing.T) {
+	viper.Set("thresholds", []map[string]interface{}{
+		{"metric": metricUsedFraction, "warning": 0.8, "hysteresis": 0.05},
+		{"metric": metricFreeBytes, "critical": 10},
+	})
+	defer viper.Set("thresholds", nil)
+	alarms, loadErr := loadAlarms([]string{"/data"})
+	if loadErr != nil {
+		t.Fatalf("Unable to load the alarms: %v", loadErr)
+	}
+	if len(alarms["/data"]) != 2 {
+		t.Fatalf("Expected 2 alarms, got %d", len(alarms["/data"]))
+	}
+
+	// with no critical level, a full disk is only a warning
+	usedAlarm := alarms["/data"][0]
+	for _, step := range []struct {
+		value float64
+		level alarmLevel
+	}{{0.1, alarmOK}, {0.5, alarmOK}, {0.99, alarmWarning}, {1, alarmWarning}, {0.78, alarmWarning}, {0.7, alarmOK}} {
+		if usedAlarm.level = usedAlarm.evaluate(step.value); usedAlarm.level != step.level {
+			t.Errorf("%s at %v: got %s, want %s", usedAlarm.metric, step.value, usedAlarm.level, step.level)
+		}
+	}
+
+	// with no warning level, nothing short of critical raises the alarm
+	freeAlarm := alarms["/data"][1]
+	for _, step := range []struct {
+		value float64
+		level alarmLevel
+	}{{1e12, alarmOK}, {11, alarmOK}, {0, alarmCritical}, {10, alarmCritical}, {20, alarmOK}} {
+		if freeAlarm.level = freeAlarm.evaluate(step.value); freeAlarm.level != step.level {
+			t.Errorf("%s at %v: got %s, want %s", freeAlarm.metric, step.value, freeAlarm.level, step.level)
+		}
+	}
+}
+
+func TestAlarmNoLevels(t *testing.T) {
+	viper.Set("thresholds", []map[string]interface{}{
+		{"metric": metricUsedFraction, "hysteresis": 0.05},
+	})
+	defer viper.Set("thresholds", nil)
+	if _, loadErr := loadAlarms([]string{"/data"}); loadErr == nil {
+		t.Errorf("A threshold with no levels should be an error")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// bufferedAlert is an alert that couldn't be sent, in the form it's kept in the buffer (and the buffer file)
+type bufferedAlert struct {
+	Target    string      `json:"target"`
+	Timestamp string      `json:"timestamp"`
+	Queued    time.Time   `json:"queued"`
+	Payload   interface{} `json:"payload"`
+}
+
+// alertBuffer keeps alerts that couldn't be sent, e.g. while the broker is down, and sends them again in order once
+// sending works again.  They keep their original timestamps, so the readings land where they belong in the history.
+// The oldest alerts are dropped when there are more than maxSize, or when they're older than maxAge.
+// If path is set, the buffer is kept in that file too, so that it survives a restart.  While the broker is down every
+// alert ends up here, so the file is written at most once every saveInterval rather than for each one.
+type alertBuffer struct {
+	maxSize      int
+	maxAge       time.Duration
+	path         string
+	saveInterval time.Duration
+	alerts       []bufferedAlert
+
+	// the alerts have changed since the file was last written
+	dirty     bool
+	lastSaved time.Time
+}
+
+// pendingAlerts is the buffer used by sendAlert; it's nil if buffering is disabled
+var pendingAlerts *alertBuffer
+
+// newAlertBuffer reads the buffer configuration; it returns nil if "buffer-size" is 0
+func newAlertBuffer() (b *alertBuffer, e error) {
+	if viper.GetInt("buffer-size") <= 0 {
+		return
+	}
+	b = &alertBuffer{
+		maxSize:      viper.GetInt("buffer-size"),
+		maxAge:       viper.GetDuration("buffer-max-age"),
+		path:         viper.GetString("buffer-file"),
+		saveInterval: viper.GetDuration("buffer-save-interval"),
+	}
+	if b.maxAge <= 0 {
+		e = fmt.Errorf("The buffer-max-age must be positive when buffering is enabled")
+		return
+	}
+	if b.saveInterval < 0 {
+		e = fmt.Errorf("The buffer-save-interval must not be negative")
+		return
+	}
+	if b.path == "" {
+		logging.Log.Noticef("Up to %d unsent alerts will be kept for %v", b.maxSize, b.maxAge)
+		return
+	}
+
+	contents, readErr := ioutil.ReadFile(b.path)
+	switch {
+	case os.IsNotExist(readErr):
+	case readErr != nil:
+		e = readErr
+		return
+	default:
+		if e = json.Unmarshal(contents, &b.alerts); e != nil {
+			return
+		}
+		b.expire()
+		logging.Log.Noticef("%d unsent alerts loaded from <%s>", len(b.alerts), b.path)
+	}
+	logging.Log.Noticef("Up to %d unsent alerts will be kept for %v in <%s>, saved at most every %v", b.maxSize, b.maxAge, b.path, b.saveInterval)
+	return
+}
+
+// expire drops the alerts that are too old to be worth sending
+func (b *alertBuffer) expire() {
+	nExpired := 0
+	for nExpired < len(b.alerts) && time.Since(b.alerts[nExpired].Queued) > b.maxAge {
+		nExpired++
+	}
+	if nExpired > 0 {
+		b.alerts = b.alerts[nExpired:]
+		logging.Log.Warningf("Dropped %d unsent alerts older than %v", nExpired, b.maxAge)
+	}
+}
+
+// add keeps an alert that couldn't be sent, dropping the oldest one if the buffer is full
+func (b *alertBuffer) add(alert dripline.Alert) {
+	b.alerts = append(b.alerts, bufferedAlert{
+		Target:    alert.Message.Target,
+		Timestamp: alert.Message.Timestamp,
+		Queued:    time.Now(),
+		Payload:   alert.Message.Payload,
+	})
+	if len(b.alerts) > b.maxSize {
+		b.alerts = b.alerts[len(b.alerts)-b.maxSize:]
+		logging.Log.Warningf("The buffer of unsent alerts is full; dropped the oldest")
+	}
+	logging.Log.Infof("Alert to <%s> kept to send later; %d waiting", alert.Message.Target, len(b.alerts))
+	b.dirty = true
+	b.saveIfDue()
+}
+
+// replay sends the buffered alerts, oldest first, until one fails.
+// It's called for every alert that's sent, so it's also where changes that haven't been saved yet get written.
+func (b *alertBuffer) replay(service *dripline.AmqpService) {
+	defer b.saveIfDue()
+	if len(b.alerts) == 0 {
+		return
+	}
+	nBefore := len(b.alerts)
+	b.expire()
+	nSent := 0
+	for _, buffered := range b.alerts {
+		alert := dripline.PrepareAlert(buffered.Target, "application/json", MasterSenderInfo)
+		alert.Message.Timestamp = buffered.Timestamp
+		alert.Message.Payload = buffered.Payload
+		if sendErr := service.SendAlert(alert); sendErr != nil {
+			logging.Log.Debugf("Still unable to send alerts: %v", sendErr)
+			break
+		}
+		nSent++
+	}
+	b.alerts = b.alerts[nSent:]
+	if nSent > 0 {
+		logging.Log.Noticef("Sent %d alerts that had been kept; %d waiting", nSent, len(b.alerts))
+	}
+	if len(b.alerts) != nBefore {
+		b.dirty = true
+	}
+}
+
+// saveIfDue writes the buffer file if the alerts have changed and it's been long enough since it was last written
+func (b *alertBuffer) saveIfDue() {
+	if b.dirty && time.Since(b.lastSaved) >= b.saveInterval {
+		b.save()
+	}
+}
+
+// save writes the buffer file, if there is one; the old file is replaced only once the new one is complete
+func (b *alertBuffer) save() {
+	if b.path == "" {
+		return
+	}
+	if b.alerts == nil {
+		b.alerts = []bufferedAlert{}
+	}
+	contents, jsonErr := json.Marshal(b.alerts)
+	if jsonErr != nil {
+		logging.Log.Errorf("Unable to encode the unsent alerts: %v", jsonErr)
+		return
+	}
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if tempErr != nil {
+		logging.Log.Errorf("Unable to save the unsent alerts: %v", tempErr)
+		return
+	}
+	_, writeErr := tempFile.Write(contents)
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tempFile.Name(), b.path)
+	}
+	if writeErr != nil {
+		os.Remove(tempFile.Name())
+		logging.Log.Errorf("Unable to save the unsent alerts: %v", writeErr)
+		return
+	}
+	b.dirty = false
+	b.lastSaved = time.Now()
+}
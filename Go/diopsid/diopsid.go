@@ -1,6 +1,7 @@
 /* This program will look at specified folder on the machine where it is running and get used space.
 It will then send an alert to the sensor_value.disks_{machine}_{diskname} queue about these two pieces of information.
 It will then go to sleep for a specified amount of time.
+In between, it answers dripline requests on its subscribe-queue (see handleRequest).
 
 Created: Mathieu Guigue, Dec 1 2016
 Last update: Walter Pettus, Oct 1 2017
@@ -15,9 +16,7 @@ import (
 	// "path/filepath"
 	//"reflect"
 	// "strconv"
-	"strings"
-	"syscall"
-	//"sync"
+	"sync"
 	"time"
 
 	"github.com/kardianos/osext"
@@ -29,26 +28,9 @@ import (
 
 	"github.com/project8/swarm/Go/authentication"
 	"github.com/project8/swarm/Go/logging"
-	// "github.com/project8/swarm/Go/utility"
+	"github.com/project8/swarm/Go/utility"
 )
 
-type DiskStatus struct {
-	Used     uint64  `json:"used"`
-	Fraction float64 `json:"fraction"`
-}
-
-// disk usage of path/disk
-func DiskUsage(path string) (disk DiskStatus) {
-	fs := syscall.Statfs_t{}
-	err := syscall.Statfs(path, &fs)
-	if err != nil {
-		return
-	}
-	disk.Used = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
-	disk.Fraction = float64(fs.Blocks-fs.Bfree) / float64(fs.Blocks-fs.Bfree+fs.Bavail)
-	return
-}
-
 const (
 	B  = 1
 	KB = 1024 * B
@@ -82,6 +64,27 @@ func fillMasterSenderInfo() (e error) {
 	return
 }
 
+// sendLock keeps the directory-size scans and the main loop from sending at the same time
+var sendLock sync.Mutex
+
+// sendAlert sends an alert, or, if buffering is enabled, keeps it to send later if it can't be sent now.
+// Alerts that were kept are sent first, so that the alerts arrive in order.
+func sendAlert(service *dripline.AmqpService, alert dripline.Alert) (e error) {
+	sendLock.Lock()
+	defer sendLock.Unlock()
+	if pendingAlerts == nil {
+		return service.SendAlert(alert)
+	}
+	pendingAlerts.replay(service)
+	if len(pendingAlerts.alerts) == 0 {
+		if e = service.SendAlert(alert); e == nil {
+			return
+		}
+	}
+	pendingAlerts.add(alert)
+	return
+}
+
 func main() {
 	logging.InitializeLogging()
 
@@ -111,8 +114,40 @@ func main() {
 	viper.SetDefault("log-level", "INFO")
 	viper.SetDefault("broker", "localhost")
 	viper.SetDefault("wait-interval", "1m")
-	viper.SetDefault("subscribe-queue", "diopsid-queue")
-	viper.SetDefault("alerts-queue-base", "sensor_value.disks_machinename_")
+	viper.SetDefault("subscribe-queue", "diopsid_{machine}")
+	viper.SetDefault("alerts-queue-base", "sensor_value.disks_{machine}_")
+	viper.SetDefault("discover-mounts", false)
+	viper.SetDefault("mountinfo-path", "/proc/self/mountinfo")
+	viper.SetDefault("error-alerts-queue-base", "status_message.error.disks_{machine}_")
+	viper.SetDefault("hung-alerts-queue-base", "status_message.critical.disks_{machine}_")
+	viper.SetDefault("probe-timeout", "10s")
+	viper.SetDefault("alarms-queue-base", "status_message.warning.disks_{machine}_")
+	viper.SetDefault("renotify-interval", "1h")
+	viper.SetDefault("slack-channel", "")
+	viper.SetDefault("slack-username", "diopsid")
+	viper.SetDefault("fill-rate-window", "6h")
+	viper.SetDefault("fill-rate-min-samples", 5)
+	viper.SetDefault("fill-horizon", "0s")
+	viper.SetDefault("fill-horizon-hysteresis", "1h")
+	viper.SetDefault("du-interval", "0s")
+	viper.SetDefault("du-alerts-queue-base", "sensor_value.du_{machine}_")
+	viper.SetDefault("du-depth", 2)
+	viper.SetDefault("du-workers", 4)
+	viper.SetDefault("du-rate-limit", 1000)
+	viper.SetDefault("du-top-n", 10)
+	viper.SetDefault("diskstats", false)
+	viper.SetDefault("diskstats-path", "/proc/diskstats")
+	viper.SetDefault("diskstats-alerts-queue-base", "sensor_value.diskstats_{machine}_")
+	viper.SetDefault("smart", false)
+	viper.SetDefault("smartctl-command", "smartctl --json --all {device}")
+	viper.SetDefault("smart-interval", "1h")
+	viper.SetDefault("smart-timeout", "30s")
+	viper.SetDefault("smart-alerts-queue-base", "sensor_value.smart_{machine}_")
+	viper.SetDefault("sysfs-block-path", "/sys/class/block")
+	viper.SetDefault("buffer-size", 1000)
+	viper.SetDefault("buffer-max-age", "24h")
+	viper.SetDefault("buffer-file", "")
+	viper.SetDefault("buffer-save-interval", "1m")
 
 	// load config
 	if configFile != "" {
@@ -126,20 +161,34 @@ func main() {
 	logging.ConfigureLogging(viper.GetString("log-level"))
 	logging.Log.Infof("Log level: %v", viper.GetString("log-level"))
 
-	wheretolook := viper.GetStringSlice("where-to-look")
-	if len(wheretolook) == 0 {
+	if viper.GetDuration("probe-timeout") <= 0 {
+		logging.Log.Criticalf("Invalid probe-timeout <%s>: should be positive", viper.GetString("probe-timeout"))
+		os.Exit(1)
+	}
+
+	dirs, dirsErr := loadDirectories()
+	if dirsErr != nil {
+		logging.Log.Criticalf("Unable to get the directories to monitor: %v", dirsErr)
+		os.Exit(1)
+	}
+	if len(dirs) == 0 {
 		logging.Log.Critical("No directories were provided")
 		os.Exit(1)
 	}
-	for i, dir := range wheretolook {
-		wheretolook[i] = strings.TrimSuffix(dir, "/")
+
+	// queue names and routing keys are templates; see utility.ExpandTemplate
+	hostVars, hostErr := utility.HostVariables()
+	if hostErr != nil {
+		logging.Log.Criticalf("Unable to get the template variables: %v", hostErr)
+		os.Exit(1)
 	}
-	logging.Log.Debugf("wheretolook after trimming trailing '/' : %q", wheretolook)
 
 	broker := viper.GetString("broker")
-	queueName := viper.GetString("subscribe-queue")
-	alertsQueueBase := viper.GetString("alerts-queue-base")
-	waitInterval := viper.GetDuration("wait-interval")
+	queueName, queueErr := utility.ExpandTemplate(viper.GetString("subscribe-queue"), hostVars)
+	if queueErr != nil {
+		logging.Log.Criticalf("Unable to make the queue name: %v", queueErr)
+		os.Exit(1)
+	}
 
 	// check authentication for desired username
 	if authErr := authentication.Load(); authErr != nil {
@@ -172,31 +221,65 @@ func main() {
 		logging.Log.Criticalf("Could not subscribe to alerts at <%v>: %v", subscriptionKey, subscribeErr)
 		os.Exit(1)
 	}
+	if subscribeErr := service.SubscribeToRequests(subscriptionKey); subscribeErr != nil {
+		logging.Log.Criticalf("Could not subscribe to requests at <%v>: %v", subscriptionKey, subscribeErr)
+		os.Exit(1)
+	}
 
 	if msiErr := fillMasterSenderInfo(); msiErr != nil {
 		logging.Log.Criticalf("Could not fill out master sender info: %v", MasterSenderInfo)
 		os.Exit(1)
 	}
 
+	var bufferErr error
+	if pendingAlerts, bufferErr = newAlertBuffer(); bufferErr != nil {
+		logging.Log.Criticalf("Unable to set up the buffer of unsent alerts: %v", bufferErr)
+		os.Exit(1)
+	}
+
+	alarmer, alarmerErr := newAlarmNotifier(service)
+	if alarmerErr != nil {
+		logging.Log.Criticalf("Unable to set up alarm notifications: %v", alarmerErr)
+		os.Exit(1)
+	}
+
+	theMonitor := newMonitor(service, alarmer, hostVars)
+	if setErr := theMonitor.setDirectories(dirs); setErr != nil {
+		logging.Log.Criticalf("Unable to set up monitoring: %v", setErr)
+		os.Exit(1)
+	}
+
+	// the directory sizes take much longer to add up, so they're scanned separately, at their own pace
+	if duInterval := viper.GetDuration("du-interval"); duInterval > 0 {
+		go runDuScans(theMonitor, duInterval)
+	}
+
+	// smartctl can take a while for each disk, so the SMART data is read separately too
+	if theMonitor.health != nil && theMonitor.health.smartCommand != "" {
+		go runSmartScans(theMonitor)
+	}
+
+	// scan right away and then every wait-interval, and answer requests in between;
+	// a ticker keeps the scans regular however long each one takes
+	theMonitor.scan()
+	waitInterval := theMonitor.currentWaitInterval()
+	ticker := time.NewTicker(waitInterval)
 	for {
-		for _, dir := range wheretolook {
-			diskname := strings.Split(dir, "/")
-			alert := dripline.PrepareAlert(alertsQueueBase+diskname[len(diskname)-1], "application/json", MasterSenderInfo)
-			disk := DiskUsage(dir)
-			var payload map[string]interface{}
-			payload = make(map[string]interface{})
-			payload["value_raw"] = float64(disk.Used) / float64(GB)
-			payload["value_cal"] = disk.Fraction
-			alert.Message.Payload = payload
-
-			e := service.SendAlert(alert)
-			if e != nil {
-				logging.Log.Errorf("Could not send the alert: %v", e)
+		select {
+		case <-ticker.C:
+			theMonitor.scan()
+		case request, chanOpen := <-service.Receiver.RequestChan:
+			if !chanOpen {
+				logging.Log.Critical("Incoming request channel is closed")
+				os.Exit(1)
+			}
+			logging.Log.Debug("Received request")
+			theMonitor.handleRequest(request, queueName)
+			if newInterval := theMonitor.currentWaitInterval(); newInterval != waitInterval {
+				ticker.Stop()
+				waitInterval = newInterval
+				ticker = time.NewTicker(waitInterval)
 			}
-			logging.Log.Infof("Alert sent: [%s] Used: %d KB, Use Fraction: %.3f", dir, disk.Used/KB, disk.Fraction)
-			time.Sleep(2 * time.Second)
 		}
-		logging.Log.Infof("Sleeping now")
-		time.Sleep(waitInterval)
 	}
 }
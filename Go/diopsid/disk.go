@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"syscall"
+)
+
+type DiskStatus struct {
+	Total    uint64  `json:"total"`
+	Free     uint64  `json:"free"`
+	Avail    uint64  `json:"avail"`
+	Used     uint64  `json:"used"`
+	Fraction float64 `json:"fraction"`
+
+	Inodes         uint64  `json:"inodes"`
+	InodesFree     uint64  `json:"inodes_free"`
+	InodesUsed     uint64  `json:"inodes_used"`
+	InodesFraction float64 `json:"inodes_fraction"`
+
+	FsType   string `json:"fs_type"`
+	ReadOnly bool   `json:"read_only"`
+
+	// from the usage history rather than statfs; HoursToFull is +Inf if the usage isn't growing
+	FillRate    float64 `json:"fill_rate"`
+	HoursToFull float64 `json:"hours_to_full"`
+}
+
+// payload is the form of the status that's sent in alerts and replies
+func (disk DiskStatus) payload() map[string]interface{} {
+	var payload map[string]interface{}
+	payload = make(map[string]interface{})
+	payload["value_raw"] = float64(disk.Used) / float64(GB)
+	payload["value_cal"] = disk.Fraction
+	payload["total_bytes"] = disk.Total
+	payload["free_bytes"] = disk.Free
+	payload["avail_bytes"] = disk.Avail
+	payload["used_bytes"] = disk.Used
+	payload["inodes_total"] = disk.Inodes
+	payload["inodes_free"] = disk.InodesFree
+	payload["inodes_used"] = disk.InodesUsed
+	payload["inodes_fraction"] = disk.InodesFraction
+	payload["fs_type"] = disk.FsType
+	payload["read_only"] = disk.ReadOnly
+	payload["fill_rate_bytes_per_hour"] = disk.FillRate
+	// JSON has no infinity, so there's no time to full if the disk isn't filling up
+	if !math.IsInf(disk.HoursToFull, 1) {
+		payload["time_to_full_hours"] = disk.HoursToFull
+	}
+	return payload
+}
+
+// ST_RDONLY from statvfs.h; the flag is the same for statfs
+const stRdOnly = 0x0001
+
+// filesystem magic numbers from statfs(2)
+var fsTypeNames = map[int64]string{
+	0x0000EF53: "ext4",
+	0x58465342: "xfs",
+	0x9123683E: "btrfs",
+	0x2FC12FC1: "zfs",
+	0x00006969: "nfs",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x01021994: "tmpfs",
+	0x794C7630: "overlayfs",
+	0x65735546: "fuse",
+	0x47504653: "gpfs",
+	0x0BD00BD0: "lustre",
+	0x00C36400: "ceph",
+	0x73717368: "squashfs",
+	0x00004D44: "vfat",
+	0x5346544E: "ntfs",
+	0x00009660: "iso9660",
+}
+
+func fsTypeName(magic int64) string {
+	if name, known := fsTypeNames[magic]; known {
+		return name
+	}
+	return fmt.Sprintf("0x%x", magic)
+}
+
+// disk usage of path/disk
+func DiskUsage(path string) (disk DiskStatus, e error) {
+	fs := syscall.Statfs_t{}
+	if e = syscall.Statfs(path, &fs); e != nil {
+		return
+	}
+	disk.Total = fs.Blocks * uint64(fs.Bsize)
+	disk.Free = fs.Bfree * uint64(fs.Bsize)
+	disk.Avail = fs.Bavail * uint64(fs.Bsize)
+	disk.Used = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+	// as with df, the fraction is of the space available to unprivileged users
+	if usable := fs.Blocks - fs.Bfree + fs.Bavail; usable > 0 {
+		disk.Fraction = float64(fs.Blocks-fs.Bfree) / float64(usable)
+	}
+
+	disk.Inodes = fs.Files
+	disk.InodesFree = fs.Ffree
+	disk.InodesUsed = fs.Files - fs.Ffree
+	// some filesystems (e.g. btrfs) don't have a fixed number of inodes, and report 0
+	if fs.Files > 0 {
+		disk.InodesFraction = float64(disk.InodesUsed) / float64(fs.Files)
+	}
+
+	disk.FsType = fsTypeName(int64(fs.Type))
+	disk.ReadOnly = fs.Flags&stRdOnly != 0
+	return
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// rateLimiter spaces out filesystem operations to at most one per interval, so that a scan doesn't starve data-taking of I/O.
+// The methods are safe to call on a nil limiter, in which case there's no limit.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until n more operations are allowed
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wakeAt := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.lock.Unlock()
+	time.Sleep(time.Until(wakeAt))
+}
+
+// dirUsage is the size of one directory and everything below it
+type dirUsage struct {
+	path  string
+	depth int
+	bytes int64
+}
+
+// duScanner adds up the disk usage under a directory, like du -x: space is counted in allocated blocks,
+// and other filesystems mounted below the directory are skipped.
+// Subdirectories are read in parallel by up to nWorkers goroutines.
+type duScanner struct {
+	maxDepth int
+	limiter  *rateLimiter
+	workers  chan struct{}
+	device   uint64
+
+	lock     sync.Mutex
+	usages   []dirUsage
+	nDirs    int
+	nErrors  int
+	nSkipped int
+}
+
+func newDuScanner(maxDepth int, nWorkers int, limiter *rateLimiter) *duScanner {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	return &duScanner{
+		maxDepth: maxDepth,
+		limiter:  limiter,
+		// the scan's own goroutine counts as a worker
+		workers: make(chan struct{}, nWorkers-1),
+	}
+}
+
+// allocated returns the space a file takes up on disk
+func allocated(info os.FileInfo) int64 {
+	if stat, isStat := info.Sys().(*syscall.Stat_t); isStat {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+func deviceOf(info os.FileInfo) (device uint64, ok bool) {
+	if stat, isStat := info.Sys().(*syscall.Stat_t); isStat {
+		return uint64(stat.Dev), true
+	}
+	return
+}
+
+// scan returns the usage of root, and records that of each subdirectory down to maxDepth
+func (s *duScanner) scan(root string) (total int64, e error) {
+	rootInfo, statErr := os.Lstat(root)
+	if statErr != nil {
+		e = statErr
+		return
+	}
+	s.device, _ = deviceOf(rootInfo)
+	total = allocated(rootInfo) + s.sizeOf(root, 0)
+	return
+}
+
+// sizeOf returns the usage of the contents of dirName, which is depth levels below the root
+func (s *duScanner) sizeOf(dirName string, depth int) (size int64) {
+	dirContents, readDirErr := ioutil.ReadDir(dirName)
+	s.limiter.wait(len(dirContents) + 1)
+	s.lock.Lock()
+	s.nDirs++
+	if readDirErr != nil {
+		s.nErrors++
+		s.lock.Unlock()
+		logging.Log.Debugf("Unable to read directory <%s>: %v", dirName, readDirErr)
+		return
+	}
+	s.lock.Unlock()
+
+	// the sizes of the subdirectories are collected and added up once they're all done
+	subSizes := make([]int64, len(dirContents))
+	var wait sync.WaitGroup
+	for iFile, fileInfo := range dirContents {
+		size += allocated(fileInfo)
+		if !fileInfo.IsDir() {
+			continue
+		}
+		if device, ok := deviceOf(fileInfo); ok && device != s.device {
+			s.lock.Lock()
+			s.nSkipped++
+			s.lock.Unlock()
+			continue
+		}
+
+		subDir := filepath.Join(dirName, fileInfo.Name())
+		ownSize := allocated(fileInfo)
+		subSize := &subSizes[iFile]
+		measure := func() {
+			*subSize = s.sizeOf(subDir, depth+1)
+			if depth+1 <= s.maxDepth {
+				s.lock.Lock()
+				s.usages = append(s.usages, dirUsage{path: subDir, depth: depth + 1, bytes: ownSize + *subSize})
+				s.lock.Unlock()
+			}
+		}
+		// hand the subdirectory to another goroutine if there's a worker free, otherwise do it here
+		select {
+		case s.workers <- struct{}{}:
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				defer func() { <-s.workers }()
+				measure()
+			}()
+		default:
+			measure()
+		}
+	}
+	wait.Wait()
+	for _, subSize := range subSizes {
+		size += subSize
+	}
+	return
+}
+
+// top returns the n largest subdirectories
+func (s *duScanner) top(n int) []dirUsage {
+	sort.Slice(s.usages, func(i, j int) bool { return s.usages[i].bytes > s.usages[j].bytes })
+	if n > 0 && len(s.usages) > n {
+		return s.usages[:n]
+	}
+	return s.usages
+}
+
+// runDuScans scans each directory every interval, starting right away, and sends the largest subdirectories as an alert
+func runDuScans(m *monitor, interval time.Duration) {
+	maxDepth := viper.GetInt("du-depth")
+	nWorkers := viper.GetInt("du-workers")
+	topN := viper.GetInt("du-top-n")
+	limiter := newRateLimiter(viper.GetFloat64("du-rate-limit"))
+	logging.Log.Noticef("Directory sizes will be scanned every %v (depth %d, %d workers, top %d)", interval, maxDepth, nWorkers, topN)
+
+	for {
+		for _, monitored := range m.currentDirs() {
+			start := time.Now()
+			scanner := newDuScanner(maxDepth, nWorkers, limiter)
+			total, scanErr := scanner.scan(monitored.path)
+			if scanErr != nil {
+				logging.Log.Errorf("Unable to scan <%s>: %v", monitored.path, scanErr)
+				continue
+			}
+
+			var topList []interface{}
+			for _, usage := range scanner.top(topN) {
+				entry := make(map[string]interface{})
+				entry["path"] = usage.path
+				entry["depth"] = usage.depth
+				entry["bytes"] = usage.bytes
+				// a total of zero can't be divided by, and NaN can't be sent as JSON
+				if total > 0 {
+					entry["fraction_of_total"] = float64(usage.bytes) / float64(total)
+				} else {
+					entry["fraction_of_total"] = 0.0
+				}
+				topList = append(topList, entry)
+			}
+
+			alert := dripline.PrepareAlert(monitored.duAlertsKey, "application/json", MasterSenderInfo)
+			var payload map[string]interface{}
+			payload = make(map[string]interface{})
+			payload["path"] = monitored.path
+			payload["total_bytes"] = total
+			payload["directories_scanned"] = scanner.nDirs
+			payload["unreadable_directories"] = scanner.nErrors
+			payload["other_filesystems_skipped"] = scanner.nSkipped
+			payload["duration_seconds"] = time.Since(start).Seconds()
+			payload["top"] = topList
+			alert.Message.Payload = payload
+			if e := sendAlert(m.service, alert); e != nil {
+				logging.Log.Errorf("Could not send the directory-size alert: %v", e)
+			}
+
+			var topNames []string
+			for _, usage := range scanner.top(3) {
+				topNames = append(topNames, filepath.Base(usage.path))
+			}
+			logging.Log.Infof("Directory sizes sent: [%s] Total: %d KB in %d directories; largest: %s", monitored.path, total/KB, scanner.nDirs, strings.Join(topNames, ", "))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+type usageSample struct {
+	when time.Time
+	used float64
+}
+
+// usageHistory keeps the used-bytes samples for one directory over a sliding window
+type usageHistory struct {
+	window     time.Duration
+	minSamples int
+	samples    []usageSample
+}
+
+func newUsageHistory(window time.Duration, minSamples int) *usageHistory {
+	if minSamples < 2 {
+		minSamples = 2
+	}
+	return &usageHistory{window: window, minSamples: minSamples}
+}
+
+// add records a sample and drops those that have fallen out of the window
+func (h *usageHistory) add(when time.Time, used uint64) {
+	h.samples = append(h.samples, usageSample{when: when, used: float64(used)})
+	iFirst := 0
+	for iFirst < len(h.samples) && when.Sub(h.samples[iFirst].when) > h.window {
+		iFirst++
+	}
+	h.samples = h.samples[iFirst:]
+}
+
+// fillRate is the slope, in bytes per hour, of a least-squares fit of used bytes against time.
+// ok is false if there aren't enough samples, or they all have the same time.
+func (h *usageHistory) fillRate() (bytesPerHour float64, ok bool) {
+	n := len(h.samples)
+	if n < h.minSamples {
+		return
+	}
+	// times are relative to the first sample to keep the sums well-conditioned
+	t0 := h.samples[0].when
+	var sumT, sumU, sumTT, sumTU float64
+	for _, sample := range h.samples {
+		t := sample.when.Sub(t0).Hours()
+		sumT += t
+		sumU += sample.used
+		sumTT += t * t
+		sumTU += t * sample.used
+	}
+	denominator := float64(n)*sumTT - sumT*sumT
+	if denominator == 0 {
+		return
+	}
+	bytesPerHour = (float64(n)*sumTU - sumT*sumU) / denominator
+	ok = true
+	return
+}
+
+// hoursToFull estimates how long until the available space is used up at the current fill rate.
+// It's +Inf if the usage isn't growing, or if there isn't enough data to tell.
+func (h *usageHistory) hoursToFull(avail uint64) (hours float64, bytesPerHour float64) {
+	bytesPerHour, ok := h.fillRate()
+	if !ok || bytesPerHour <= 0 {
+		return math.Inf(1), bytesPerHour
+	}
+	return float64(avail) / bytesPerHour, bytesPerHour
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+	"github.com/project8/swarm/Go/utility"
+)
+
+// diskstats counts sectors in 512-byte units, whatever the device's sector size
+const diskstatsSectorSize = 512
+
+// diskStats is one line of /proc/diskstats (see the kernel's Documentation/admin-guide/iostats.rst)
+type diskStats struct {
+	reads        uint64
+	readSectors  uint64
+	readMs       uint64
+	writes       uint64
+	writeSectors uint64
+	writeMs      uint64
+	inProgress   uint64
+	ioMs         uint64
+	time         time.Time
+}
+
+// readDiskStats parses a diskstats file into the counters of each device, by name
+func readDiskStats(path string) (stats map[string]diskStats, e error) {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	defer file.Close()
+
+	now := time.Now()
+	stats = make(map[string]diskStats)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		//    8       0 sda 4137 1385 262430 2276 6096 4290 148130 5464 0 6412 7740 ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			logging.Log.Warningf("Unable to parse diskstats line: %s", scanner.Text())
+			continue
+		}
+		var counters [11]uint64
+		parsed := true
+		for iCounter := range counters {
+			var parseErr error
+			if counters[iCounter], parseErr = strconv.ParseUint(fields[3+iCounter], 10, 64); parseErr != nil {
+				parsed = false
+				break
+			}
+		}
+		if !parsed {
+			logging.Log.Warningf("Unable to parse diskstats line: %s", scanner.Text())
+			continue
+		}
+		stats[fields[2]] = diskStats{
+			reads:        counters[0],
+			readSectors:  counters[2],
+			readMs:       counters[3],
+			writes:       counters[4],
+			writeSectors: counters[6],
+			writeMs:      counters[7],
+			inProgress:   counters[8],
+			ioMs:         counters[9],
+			time:         now,
+		}
+	}
+	e = scanner.Err()
+	return
+}
+
+// ioPayload works out the throughput, utilization and latency between two samples of a device's counters.
+// ok is false if the counters went backwards (e.g. a device was replaced, or a 32-bit counter wrapped).
+func ioPayload(previous diskStats, current diskStats) (payload map[string]interface{}, ok bool) {
+	if current.reads < previous.reads || current.writes < previous.writes || current.readSectors < previous.readSectors ||
+		current.writeSectors < previous.writeSectors || current.ioMs < previous.ioMs ||
+		current.readMs < previous.readMs || current.writeMs < previous.writeMs {
+		return
+	}
+	seconds := current.time.Sub(previous.time).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	reads := float64(current.reads - previous.reads)
+	writes := float64(current.writes - previous.writes)
+	utilization := float64(current.ioMs-previous.ioMs) / (1000 * seconds)
+	if utilization > 1 {
+		utilization = 1
+	}
+
+	payload = make(map[string]interface{})
+	// the utilization is the sensor value
+	payload["value_raw"] = utilization
+	payload["value_cal"] = utilization
+	payload["utilization"] = utilization
+	payload["reads_per_second"] = reads / seconds
+	payload["writes_per_second"] = writes / seconds
+	payload["read_bytes_per_second"] = float64((current.readSectors-previous.readSectors)*diskstatsSectorSize) / seconds
+	payload["write_bytes_per_second"] = float64((current.writeSectors-previous.writeSectors)*diskstatsSectorSize) / seconds
+	if reads > 0 {
+		payload["read_latency_ms"] = float64(current.readMs-previous.readMs) / reads
+	}
+	if writes > 0 {
+		payload["write_latency_ms"] = float64(current.writeMs-previous.writeMs) / writes
+	}
+	payload["in_progress"] = current.inProgress
+	payload["interval_seconds"] = seconds
+	return payload, true
+}
+
+// blockDeviceName returns the kernel name (as in diskstats) of a mount's device, e.g. sda1 for /dev/sda1, and dm-0 for
+// /dev/mapper/vg-data; ok is false for mounts that aren't on a block device, like NFS or tmpfs
+func blockDeviceName(device string) (name string, ok bool) {
+	if !strings.HasPrefix(device, "/dev/") {
+		return
+	}
+	if resolved, linkErr := filepath.EvalSymlinks(device); linkErr == nil {
+		device = resolved
+	}
+	return filepath.Base(device), true
+}
+
+// wholeDevice returns the disk a partition is on (e.g. sda for sda1), which is what SMART is read from
+func wholeDevice(sysfsPath string, name string) string {
+	if _, statErr := os.Stat(filepath.Join(sysfsPath, name, "partition")); statErr != nil {
+		return name
+	}
+	// /sys/class/block/sda1 -> ../../devices/.../block/sda/sda1
+	resolved, linkErr := filepath.EvalSymlinks(filepath.Join(sysfsPath, name))
+	if linkErr != nil {
+		return name
+	}
+	return filepath.Base(filepath.Dir(resolved))
+}
+
+// smartctlOutput is the part of the output of smartctl --json that's used
+type smartctlOutput struct {
+	Smartctl struct {
+		Messages []struct {
+			String string `json:"string"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	ModelName    string `json:"model_name"`
+	SerialNumber string `json:"serial_number"`
+	SmartStatus  *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current float64 `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime *struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	AtaSmartAttributes *struct {
+		Table []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+			Raw  struct {
+				Value uint64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NvmeSmartHealthInformationLog *struct {
+		MediaErrors    uint64 `json:"media_errors"`
+		PercentageUsed uint64 `json:"percentage_used"`
+		AvailableSpare uint64 `json:"available_spare"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// ATA SMART attributes that count bad sectors
+var smartSectorAttributes = map[int]string{
+	5:   "reallocated_sectors",
+	197: "pending_sectors",
+	198: "offline_uncorrectable_sectors",
+}
+
+// parseSmartctl makes a payload from the output of smartctl --json.
+// Drives report different things, so only what's present is included.
+func parseSmartctl(output []byte) (payload map[string]interface{}, e error) {
+	var smart smartctlOutput
+	if jsonErr := json.Unmarshal(output, &smart); jsonErr != nil {
+		e = fmt.Errorf("Unable to decode the smartctl output: %v", jsonErr)
+		return
+	}
+	if smart.SmartStatus == nil && smart.Temperature == nil && smart.AtaSmartAttributes == nil && smart.NvmeSmartHealthInformationLog == nil {
+		var messages []string
+		for _, message := range smart.Smartctl.Messages {
+			messages = append(messages, message.String)
+		}
+		e = fmt.Errorf("No SMART data: %s", strings.Join(messages, "; "))
+		return
+	}
+
+	payload = make(map[string]interface{})
+	payload["model"] = smart.ModelName
+	payload["serial_number"] = smart.SerialNumber
+	if smart.SmartStatus != nil {
+		payload["passed"] = smart.SmartStatus.Passed
+	}
+	if smart.Temperature != nil {
+		// the temperature is the sensor value
+		payload["value_raw"] = smart.Temperature.Current
+		payload["value_cal"] = smart.Temperature.Current
+		payload["temperature_celsius"] = smart.Temperature.Current
+	}
+	if smart.PowerOnTime != nil {
+		payload["power_on_hours"] = smart.PowerOnTime.Hours
+	}
+	if smart.AtaSmartAttributes != nil {
+		for _, attribute := range smart.AtaSmartAttributes.Table {
+			if name, isCounted := smartSectorAttributes[attribute.ID]; isCounted {
+				payload[name] = attribute.Raw.Value
+			}
+		}
+	}
+	if smart.NvmeSmartHealthInformationLog != nil {
+		payload["media_errors"] = smart.NvmeSmartHealthInformationLog.MediaErrors
+		payload["percentage_used"] = smart.NvmeSmartHealthInformationLog.PercentageUsed
+		payload["available_spare"] = smart.NvmeSmartHealthInformationLog.AvailableSpare
+	}
+	return
+}
+
+// healthCollector reads the I/O statistics and SMART data of the block devices the directories are on.
+// The I/O statistics are read in the scans; smartctl can take a while, so the SMART data is read in a goroutine of its own,
+// at its own pace (see runSmartScans).  That goroutine only uses the settings, so nothing here is locked.
+type healthCollector struct {
+	diskstatsPath string
+	sysfsPath     string
+	smartCommand  string
+	smartInterval time.Duration
+	smartTimeout  time.Duration
+
+	// only used by the scans
+	previous map[string]diskStats
+}
+
+// newHealthCollector reads the configuration; it returns nil if neither "diskstats" nor "smart" is enabled
+func newHealthCollector() *healthCollector {
+	h := &healthCollector{
+		sysfsPath:     viper.GetString("sysfs-block-path"),
+		smartInterval: viper.GetDuration("smart-interval"),
+		smartTimeout:  viper.GetDuration("smart-timeout"),
+		previous:      make(map[string]diskStats),
+	}
+	if viper.GetBool("diskstats") {
+		h.diskstatsPath = viper.GetString("diskstats-path")
+		logging.Log.Noticef("I/O statistics will be read from <%s>", h.diskstatsPath)
+	}
+	if viper.GetBool("smart") {
+		if h.smartInterval > 0 {
+			h.smartCommand = viper.GetString("smartctl-command")
+			logging.Log.Noticef("SMART data will be read every %v with <%s>", h.smartInterval, h.smartCommand)
+		} else {
+			logging.Log.Errorf("The smart-interval must be positive; SMART data won't be read")
+		}
+	}
+	if h.diskstatsPath == "" && h.smartCommand == "" {
+		return nil
+	}
+	return h
+}
+
+// runSmartctl runs the smartctl command for a device (e.g. sda).
+// smartctl's exit status is a bit mask that's often non-zero even when it prints the data, so it's only an error if nothing was printed.
+func (h *healthCollector) runSmartctl(device string) (output []byte, e error) {
+	commandLine, expandErr := utility.ExpandTemplate(h.smartCommand, map[string]string{"device": "/dev/" + device, "name": device})
+	if expandErr != nil {
+		e = expandErr
+		return
+	}
+	args := strings.Fields(commandLine)
+	if len(args) == 0 {
+		e = fmt.Errorf("The smartctl command is empty")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.smartTimeout)
+	defer cancel()
+	output, e = exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if len(output) > 0 {
+		e = nil
+	}
+	return
+}
+
+// collectIO sends the I/O statistics of each directory's device
+func (h *healthCollector) collectIO(service *dripline.AmqpService, dirs []monitoredDir) {
+	if h == nil || h.diskstatsPath == "" {
+		return
+	}
+	stats, statsErr := readDiskStats(h.diskstatsPath)
+	if statsErr != nil {
+		logging.Log.Errorf("Unable to read the I/O statistics: %v", statsErr)
+		return
+	}
+
+	for _, monitored := range dirs {
+		name, isBlock := blockDeviceName(monitored.device)
+		if !isBlock {
+			logging.Log.Debugf("<%s> is not on a block device (%s)", monitored.path, monitored.device)
+			continue
+		}
+		current, found := stats[name]
+		if !found {
+			logging.Log.Debugf("No I/O statistics for %s", name)
+			continue
+		}
+		previous, seen := h.previous[name]
+		if !seen {
+			continue
+		}
+		payload, ok := ioPayload(previous, current)
+		if !ok {
+			continue
+		}
+		payload["device"] = name
+		payload["path"] = monitored.path
+		alert := dripline.PrepareAlert(monitored.diskstatsAlertsKey, "application/json", MasterSenderInfo)
+		alert.Message.Payload = payload
+		if e := sendAlert(service, alert); e != nil {
+			logging.Log.Errorf("Could not send the I/O statistics alert: %v", e)
+		}
+		logging.Log.Infof("I/O statistics sent: [%s] %s, Utilization: %.3f", monitored.path, name, payload["utilization"])
+	}
+
+	for name, current := range stats {
+		h.previous[name] = current
+	}
+}
+
+// collectSmart sends the SMART data of each directory's disk
+func (h *healthCollector) collectSmart(service *dripline.AmqpService, dirs []monitoredDir) {
+	// several directories can be on the same disk, so each disk is only read once
+	smartPayloads := make(map[string]map[string]interface{})
+
+	for _, monitored := range dirs {
+		name, isBlock := blockDeviceName(monitored.device)
+		if !isBlock {
+			continue
+		}
+		disk := wholeDevice(h.sysfsPath, name)
+		if _, isRead := smartPayloads[disk]; !isRead {
+			output, smartErr := h.runSmartctl(disk)
+			if smartErr == nil {
+				smartPayloads[disk], smartErr = parseSmartctl(output)
+			}
+			if smartErr != nil {
+				logging.Log.Warningf("Unable to read the SMART data of %s: %v", disk, smartErr)
+				smartPayloads[disk] = nil
+			}
+		}
+		if smartPayloads[disk] == nil {
+			continue
+		}
+		payload := make(map[string]interface{})
+		for key, value := range smartPayloads[disk] {
+			payload[key] = value
+		}
+		payload["device"] = disk
+		payload["path"] = monitored.path
+		alert := dripline.PrepareAlert(monitored.smartAlertsKey, "application/json", MasterSenderInfo)
+		alert.Message.Payload = payload
+		if e := sendAlert(service, alert); e != nil {
+			logging.Log.Errorf("Could not send the SMART alert: %v", e)
+		}
+		logging.Log.Infof("SMART data sent: [%s] %s", monitored.path, disk)
+	}
+}
+
+// runSmartScans reads the SMART data of the directories' disks every smart-interval, starting right away
+func runSmartScans(m *monitor) {
+	for {
+		m.health.collectSmart(m.service, m.currentDirs())
+		time.Sleep(m.health.smartInterval)
+	}
+}
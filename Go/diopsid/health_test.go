@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDiskStats(t *testing.T) {
+	stats, readErr := readDiskStats(filepath.Join("testdata", "diskstats"))
+	if readErr != nil {
+		t.Fatalf("Unable to read the diskstats: %v", readErr)
+	}
+	// the malformed dm-1 line is skipped
+	if len(stats) != 6 {
+		t.Errorf("Expected 6 devices, got %d", len(stats))
+	}
+	if _, found := stats["dm-1"]; found {
+		t.Errorf("The malformed line for dm-1 should have been skipped")
+	}
+
+	sda, found := stats["sda"]
+	if !found {
+		t.Fatalf("No counters for sda")
+	}
+	expected := diskStats{
+		reads:        1847723,
+		readSectors:  180322114,
+		readMs:       1210845,
+		writes:       9835713,
+		writeSectors: 1322694632,
+		writeMs:      43226934,
+		inProgress:   0,
+		ioMs:         9128612,
+		time:         sda.time,
+	}
+	if sda != expected {
+		t.Errorf("Wrong counters for sda:\n got %+v\nwant %+v", sda, expected)
+	}
+	if stats["sda1"].inProgress != 3 {
+		t.Errorf("Expected 3 I/Os in progress for sda1, got %d", stats["sda1"].inProgress)
+	}
+	if stats["nvme0n1p1"].writeSectors != 70418928 {
+		t.Errorf("Wrong written sectors for nvme0n1p1: %d", stats["nvme0n1p1"].writeSectors)
+	}
+}
+
+func TestIoPayload(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous := diskStats{reads: 1000, readSectors: 20000, readMs: 500, writes: 2000, writeSectors: 40000, writeMs: 1000, ioMs: 1500, time: start}
+	current := diskStats{reads: 1100, readSectors: 22000, readMs: 700, writes: 2400, writeSectors: 48000, writeMs: 1800, inProgress: 2, ioMs: 6500, time: start.Add(10 * time.Second)}
+
+	payload, ok := ioPayload(previous, current)
+	if !ok {
+		t.Fatalf("No payload for increasing counters")
+	}
+	expected := map[string]float64{
+		"utilization":            0.5,
+		"reads_per_second":       10,
+		"writes_per_second":      40,
+		"read_bytes_per_second":  2000 * diskstatsSectorSize / 10,
+		"write_bytes_per_second": 8000 * diskstatsSectorSize / 10,
+		"read_latency_ms":        2,
+		"write_latency_ms":       2,
+		"interval_seconds":       10,
+	}
+	for key, value := range expected {
+		if payload[key] != value {
+			t.Errorf("%s: got %v, want %v", key, payload[key], value)
+		}
+	}
+	if payload["in_progress"] != uint64(2) {
+		t.Errorf("in_progress: got %v, want 2", payload["in_progress"])
+	}
+
+	// with no reads or writes in between, there's no latency to report
+	idle := previous
+	idle.time = current.time
+	payload, ok = ioPayload(previous, idle)
+	if !ok {
+		t.Fatalf("No payload for unchanged counters")
+	}
+	if _, found := payload["read_latency_ms"]; found {
+		t.Errorf("There should be no read latency without reads")
+	}
+	if payload["utilization"] != 0.0 {
+		t.Errorf("Expected no utilization, got %v", payload["utilization"])
+	}
+}
+
+func TestIoPayloadCounterWrap(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous := diskStats{reads: 1000, readSectors: 20000, readMs: 500, writes: 4294967000, writeSectors: 40000, writeMs: 1000, ioMs: 1500, time: start}
+
+	// each counter in turn goes backwards, as when a 32-bit counter wraps or the device is replaced
+	wrapped := map[string]func(stats *diskStats){
+		"reads":         func(stats *diskStats) { stats.reads = 10 },
+		"read sectors":  func(stats *diskStats) { stats.readSectors = 10 },
+		"read time":     func(stats *diskStats) { stats.readMs = 10 },
+		"writes":        func(stats *diskStats) { stats.writes = 100 },
+		"write sectors": func(stats *diskStats) { stats.writeSectors = 10 },
+		"write time":    func(stats *diskStats) { stats.writeMs = 10 },
+		"I/O time":      func(stats *diskStats) { stats.ioMs = 10 },
+	}
+	for counter, wrap := range wrapped {
+		current := previous
+		current.time = start.Add(10 * time.Second)
+		wrap(&current)
+		if payload, ok := ioPayload(previous, current); ok {
+			t.Errorf("%s went backwards, but a payload was made: %v", counter, payload)
+		}
+	}
+
+	// samples taken at the same time can't give rates
+	if _, ok := ioPayload(previous, previous); ok {
+		t.Errorf("A payload was made from samples with no time in between")
+	}
+}
+
+func TestParseSmartctl(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected map[string]interface{}
+		absent   []string
+	}{
+		{
+			file: "smartctl-sata.json",
+			expected: map[string]interface{}{
+				"model":                         "WDC WD40EFRX-68N32N0",
+				"serial_number":                 "WD-WCC7K1234567",
+				"passed":                        true,
+				"value_cal":                     38.0,
+				"temperature_celsius":           38.0,
+				"power_on_hours":                uint64(43521),
+				"reallocated_sectors":           uint64(8),
+				"pending_sectors":               uint64(1),
+				"offline_uncorrectable_sectors": uint64(0),
+			},
+			absent: []string{"media_errors", "percentage_used"},
+		},
+		{
+			file: "smartctl-nvme.json",
+			expected: map[string]interface{}{
+				"model":               "Samsung SSD 970 EVO Plus 1TB",
+				"passed":              true,
+				"temperature_celsius": 41.0,
+				"power_on_hours":      uint64(9127),
+				"media_errors":        uint64(0),
+				"percentage_used":     uint64(3),
+				"available_spare":     uint64(100),
+			},
+			absent: []string{"reallocated_sectors", "pending_sectors"},
+		},
+	}
+	for _, test := range tests {
+		output, readErr := ioutil.ReadFile(filepath.Join("testdata", test.file))
+		if readErr != nil {
+			t.Fatalf("Unable to read %s: %v", test.file, readErr)
+		}
+		payload, parseErr := parseSmartctl(output)
+		if parseErr != nil {
+			t.Errorf("%s: %v", test.file, parseErr)
+			continue
+		}
+		for key, value := range test.expected {
+			if payload[key] != value {
+				t.Errorf("%s: %s: got %v (%T), want %v (%T)", test.file, key, payload[key], payload[key], value, value)
+			}
+		}
+		for _, key := range test.absent {
+			if _, found := payload[key]; found {
+				t.Errorf("%s: %s should not be in the payload", test.file, key)
+			}
+		}
+	}
+}
+
+func TestParseSmartctlNoData(t *testing.T) {
+	output, readErr := ioutil.ReadFile(filepath.Join("testdata", "smartctl-no-smart.json"))
+	if readErr != nil {
+		t.Fatalf("Unable to read smartctl-no-smart.json: %v", readErr)
+	}
+	payload, parseErr := parseSmartctl(output)
+	if parseErr == nil {
+		t.Fatalf("Expected an error, got the payload %v", payload)
+	}
+	if !strings.HasPrefix(parseErr.Error(), "No SMART data: ") || !strings.Contains(parseErr.Error(), "Unknown USB bridge") {
+		t.Errorf("The error should pass on smartctl's messages: %v", parseErr)
+	}
+
+	if _, parseErr = parseSmartctl([]byte("smartctl: command not found")); parseErr == nil {
+		t.Errorf("Expected an error for output that isn't JSON")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// reading is the latest result of checking a directory's disk
+type reading struct {
+	disk DiskStatus
+	time time.Time
+	err  error
+}
+
+// probe is a disk-usage check running in its own goroutine
+type probe struct {
+	start time.Time
+	done  chan reading
+}
+
+var errProbeTimeout = errors.New("Timed out waiting for the filesystem; the mount may be hung")
+
+// monitor holds what's being monitored and the latest readings, which can be changed and looked at through dripline requests.
+// The lock is there for the directory-size scans, which run in their own goroutine.
+type monitor struct {
+	lock         sync.RWMutex
+	service      *dripline.AmqpService
+	alarmer      *alarmNotifier
+	health       *healthCollector
+	hostVars     map[string]string
+	waitInterval time.Duration
+	probeTimeout time.Duration
+
+	dirs      []monitoredDir
+	alarms    map[string][]*alarm
+	histories map[string]*usageHistory
+	readings  map[string]reading
+	// probes that haven't returned yet, by path
+	probes map[string]*probe
+}
+
+func newMonitor(service *dripline.AmqpService, alarmer *alarmNotifier, hostVars map[string]string) *monitor {
+	return &monitor{
+		service:      service,
+		alarmer:      alarmer,
+		health:       newHealthCollector(),
+		hostVars:     hostVars,
+		waitInterval: viper.GetDuration("wait-interval"),
+		probeTimeout: viper.GetDuration("probe-timeout"),
+		histories:    make(map[string]*usageHistory),
+		readings:     make(map[string]reading),
+		probes:       make(map[string]*probe),
+	}
+}
+
+// setDirectories makes the routing keys and alarms for a new list of directories, and starts monitoring them.
+// The usage histories and readings of directories that were already being monitored are kept.
+// If anything is wrong with the new list, nothing is changed.
+func (m *monitor) setDirectories(dirs []monitoredDir) (e error) {
+	var paths []string
+	for iDir := range dirs {
+		if e = dirs[iDir].setRoutingKeys(m.hostVars); e != nil {
+			return
+		}
+		paths = append(paths, dirs[iDir].path)
+	}
+	alarms, alarmsErr := loadAlarms(paths)
+	if alarmsErr != nil {
+		e = alarmsErr
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	histories := make(map[string]*usageHistory)
+	readings := make(map[string]reading)
+	for _, dir := range dirs {
+		if latest, isRead := m.readings[dir.path]; isRead {
+			readings[dir.path] = latest
+		}
+		if history, known := m.histories[dir.path]; known {
+			histories[dir.path] = history
+		} else {
+			histories[dir.path] = newUsageHistory(viper.GetDuration("fill-rate-window"), viper.GetInt("fill-rate-min-samples"))
+		}
+		// raised alarms stay raised, rather than being announced again
+		for _, a := range alarms[dir.path] {
+			for _, old := range m.alarms[dir.path] {
+				if a.sameThresholds(old) {
+					a.level, a.lastNotified = old.level, old.lastNotified
+				}
+			}
+		}
+		logging.Log.Noticef("Monitoring <%s>; alerts go to <%s>", dir.path, dir.alertsKey)
+	}
+	m.dirs = dirs
+	m.alarms = alarms
+	m.histories = histories
+	m.readings = readings
+	return
+}
+
+// currentDirs returns a copy of the list of directories
+func (m *monitor) currentDirs() []monitoredDir {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return append([]monitoredDir(nil), m.dirs...)
+}
+
+func (m *monitor) setWaitInterval(waitInterval time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.waitInterval = waitInterval
+}
+
+func (m *monitor) currentWaitInterval() time.Duration {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.waitInterval
+}
+
+// probe reads the disk usage of path in its own goroutine, and waits for it for up to timeout.
+// A statfs on a hung mount can't be interrupted, so a probe that times out is left running, and the next scan waits for
+// it rather than starting another one.
+func (m *monitor) probe(path string, timeout time.Duration) (result reading, hungSince time.Time) {
+	m.lock.Lock()
+	p, inFlight := m.probes[path]
+	if !inFlight {
+		p = &probe{start: time.Now(), done: make(chan reading, 1)}
+		m.probes[path] = p
+		go func() {
+			disk, diskErr := DiskUsage(path)
+			if took := time.Since(p.start); took > timeout {
+				logging.Log.Noticef("<%s> responded after %v", path, took)
+			}
+			m.lock.Lock()
+			delete(m.probes, path)
+			m.lock.Unlock()
+			p.done <- reading{disk: disk, time: time.Now(), err: diskErr}
+		}()
+	}
+	m.lock.Unlock()
+
+	wait := time.NewTimer(timeout)
+	defer wait.Stop()
+	select {
+	case result = <-p.done:
+	case <-wait.C:
+		result = reading{time: time.Now(), err: errProbeTimeout}
+		hungSince = p.start
+	}
+	return
+}
+
+// scan probes all of the directories at once, and then sends the readings and any alarms
+func (m *monitor) scan() {
+	dirs := m.currentDirs()
+	m.lock.RLock()
+	timeout := m.probeTimeout
+	m.lock.RUnlock()
+
+	results := make([]reading, len(dirs))
+	hungSince := make([]time.Time, len(dirs))
+	var wait sync.WaitGroup
+	for iDir := range dirs {
+		wait.Add(1)
+		go func(iDir int) {
+			defer wait.Done()
+			results[iDir], hungSince[iDir] = m.probe(dirs[iDir].path, timeout)
+		}(iDir)
+	}
+	wait.Wait()
+
+	for iDir, monitored := range dirs {
+		dir := monitored.path
+		disk, diskErr := results[iDir].disk, results[iDir].err
+		if !hungSince[iDir].IsZero() {
+			hungFor := time.Since(hungSince[iDir])
+			logging.Log.Errorf("Disk usage for <%s> has been hanging for %v", dir, hungFor)
+			m.lock.Lock()
+			m.readings[dir] = results[iDir]
+			m.lock.Unlock()
+
+			alert := dripline.PrepareAlert(monitored.hungAlertsKey, "application/json", MasterSenderInfo)
+			var payload map[string]interface{}
+			payload = make(map[string]interface{})
+			payload["path"] = dir
+			payload["mount_point"] = monitored.mountPoint
+			payload["device"] = monitored.device
+			payload["fs_type"] = monitored.fsType
+			payload["hung_seconds"] = hungFor.Seconds()
+			payload["timeout_seconds"] = timeout.Seconds()
+			payload["error"] = diskErr.Error()
+			alert.Message.Payload = payload
+			if e := sendAlert(m.service, alert); e != nil {
+				logging.Log.Errorf("Could not send the hung-mount alert: %v", e)
+			}
+			continue
+		}
+		if diskErr != nil {
+			// a failed reading is reported as such, rather than as an empty disk
+			logging.Log.Errorf("Unable to get the disk usage for <%s>: %v", dir, diskErr)
+			m.lock.Lock()
+			m.readings[dir] = results[iDir]
+			m.lock.Unlock()
+
+			alert := dripline.PrepareAlert(monitored.errorAlertsKey, "application/json", MasterSenderInfo)
+			var payload map[string]interface{}
+			payload = make(map[string]interface{})
+			payload["path"] = dir
+			payload["error"] = diskErr.Error()
+			alert.Message.Payload = payload
+			if e := sendAlert(m.service, alert); e != nil {
+				logging.Log.Errorf("Could not send the error alert: %v", e)
+			}
+			continue
+		}
+
+		m.lock.Lock()
+		history := m.histories[dir]
+		history.add(results[iDir].time, disk.Used)
+		disk.HoursToFull, disk.FillRate = history.hoursToFull(disk.Avail)
+		m.readings[dir] = reading{disk: disk, time: results[iDir].time}
+		alarms := m.alarms[dir]
+		m.lock.Unlock()
+
+		alert := dripline.PrepareAlert(monitored.alertsKey, "application/json", MasterSenderInfo)
+		alert.Message.Payload = disk.payload()
+
+		e := sendAlert(m.service, alert)
+		if e != nil {
+			logging.Log.Errorf("Could not send the alert: %v", e)
+		}
+		logging.Log.Infof("Alert sent: [%s] Used: %d KB, Use Fraction: %.3f, Inode Fraction: %.3f, Type: %s, Read-only: %v", dir, disk.Used/KB, disk.Fraction, disk.InodesFraction, disk.FsType, disk.ReadOnly)
+		m.alarmer.check(alarms, monitored.alarmsKey, disk)
+	}
+	m.health.collectIO(m.service, dirs)
+	logging.Log.Infof("Sleeping now")
+}
+
+// readingPayload is the latest reading of a directory, as sent in replies
+func (m *monitor) readingPayload(dir monitoredDir) map[string]interface{} {
+	m.lock.RLock()
+	latest, isRead := m.readings[dir.path]
+	m.lock.RUnlock()
+
+	var payload map[string]interface{}
+	switch {
+	case !isRead:
+		payload = make(map[string]interface{})
+		payload["error"] = "not read yet"
+	case latest.err != nil:
+		payload = make(map[string]interface{})
+		payload["error"] = latest.err.Error()
+	default:
+		payload = latest.disk.payload()
+	}
+	payload["path"] = dir.path
+	payload["name"] = dir.name
+	if isRead {
+		payload["time"] = latest.time.UTC().Format(time.RFC3339)
+	}
+	return payload
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/spf13/viper"
+
+	"github.com/project8/swarm/Go/logging"
+	"github.com/project8/swarm/Go/utility"
+)
+
+// monitoredDir is a directory whose disk is monitored
+type monitoredDir struct {
+	path string
+	// routing-key suffix for the directory's alerts
+	name string
+	// the mount the directory is on, if it could be found
+	mountPoint string
+	device     string
+	fsType     string
+
+	alertsKey      string
+	errorAlertsKey string
+	alarmsKey      string
+	duAlertsKey    string
+	hungAlertsKey  string
+	// for the block-device health
+	diskstatsAlertsKey string
+	smartAlertsKey     string
+}
+
+// templateVariables adds the directory's variables to hostVars:
+//   - name: the alert name
+//   - dir: the last component of the path
+//   - path: the whole path
+//   - device, mount_point and fs_type: from the mount the directory is on
+func (dir *monitoredDir) templateVariables(hostVars map[string]string) map[string]string {
+	vars := make(map[string]string)
+	for name, value := range hostVars {
+		vars[name] = value
+	}
+	vars["name"] = dir.name
+	vars["dir"] = filepath.Base(dir.path)
+	vars["path"] = dir.path
+	vars["device"] = dir.device
+	vars["mount_point"] = dir.mountPoint
+	vars["fs_type"] = dir.fsType
+	return vars
+}
+
+// expandRoutingKey fills in a routing-key template for the directory.
+// If the template doesn't use {name}, the name is appended, as with the plain prefixes diopsid has always used.
+func (dir *monitoredDir) expandRoutingKey(template string, vars map[string]string) (key string, e error) {
+	if !utility.TemplateUses(template, "name") {
+		template += "{name}"
+	}
+	key, e = utility.ExpandTemplate(template, vars)
+	return
+}
+
+// setRoutingKeys fills in the "alerts-queue-base", "error-alerts-queue-base", "alarms-queue-base", "du-alerts-queue-base",
+// "hung-alerts-queue-base", "diskstats-alerts-queue-base" and "smart-alerts-queue-base" templates
+func (dir *monitoredDir) setRoutingKeys(hostVars map[string]string) (e error) {
+	vars := dir.templateVariables(hostVars)
+	if dir.alertsKey, e = dir.expandRoutingKey(viper.GetString("alerts-queue-base"), vars); e != nil {
+		return
+	}
+	if dir.errorAlertsKey, e = dir.expandRoutingKey(viper.GetString("error-alerts-queue-base"), vars); e != nil {
+		return
+	}
+	if dir.alarmsKey, e = dir.expandRoutingKey(viper.GetString("alarms-queue-base"), vars); e != nil {
+		return
+	}
+	if dir.duAlertsKey, e = dir.expandRoutingKey(viper.GetString("du-alerts-queue-base"), vars); e != nil {
+		return
+	}
+	if dir.hungAlertsKey, e = dir.expandRoutingKey(viper.GetString("hung-alerts-queue-base"), vars); e != nil {
+		return
+	}
+	if dir.diskstatsAlertsKey, e = dir.expandRoutingKey(viper.GetString("diskstats-alerts-queue-base"), vars); e != nil {
+		return
+	}
+	dir.smartAlertsKey, e = dir.expandRoutingKey(viper.GetString("smart-alerts-queue-base"), vars)
+	return
+}
+
+// mountInfo is one line of /proc/self/mountinfo
+type mountInfo struct {
+	mountPoint string
+	fsType     string
+	device     string
+}
+
+// directoryConfig is the configuration form of an explicitly-named directory
+type directoryConfig struct {
+	Dir  string `mapstructure:"dir"`
+	Name string `mapstructure:"name"`
+}
+
+// readMountInfo parses a mountinfo file (see proc(5)).  When a mount point appears more than once, the last (topmost) mount wins.
+func readMountInfo(path string) (mounts []mountInfo, e error) {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	defer file.Close()
+
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		iSeparator := -1
+		for iField, field := range fields {
+			if field == "-" {
+				iSeparator = iField
+				break
+			}
+		}
+		if len(fields) < 5 || iSeparator < 0 || len(fields) < iSeparator+3 {
+			logging.Log.Warningf("Unable to parse mountinfo line: %s", scanner.Text())
+			continue
+		}
+		mount := mountInfo{
+			mountPoint: unescapeMountField(fields[4]),
+			fsType:     fields[iSeparator+1],
+			device:     unescapeMountField(fields[iSeparator+2]),
+		}
+		if iMount, seen := index[mount.mountPoint]; seen {
+			mounts[iMount] = mount
+			continue
+		}
+		index[mount.mountPoint] = len(mounts)
+		mounts = append(mounts, mount)
+	}
+	e = scanner.Err()
+	return
+}
+
+// unescapeMountField replaces the octal escapes (e.g. \040 for a space) used in mountinfo
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, parseErr := strconv.ParseUint(field[i+1:i+4], 8, 8); parseErr == nil {
+				unescaped.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(field[i])
+	}
+	return unescaped.String()
+}
+
+// findMount returns the mount that path is on: the one with the longest mount point containing it
+func findMount(path string, mounts []mountInfo) (mount mountInfo, found bool) {
+	for _, candidate := range mounts {
+		if candidate.mountPoint == path || candidate.mountPoint == "/" || strings.HasPrefix(path, candidate.mountPoint+"/") {
+			if !found || len(candidate.mountPoint) > len(mount.mountPoint) {
+				mount = candidate
+				found = true
+			}
+		}
+	}
+	return
+}
+
+// nameFromPath makes an alert name from a whole path, so that /a/data and /b/data don't collide
+func nameFromPath(path string) string {
+	name := strings.Trim(path, "/")
+	if name == "" {
+		return "root"
+	}
+	return strings.NewReplacer("/", "_", ".", "_", " ", "_").Replace(name)
+}
+
+// pseudoFSTypes are the filesystems that don't hold data on a disk: the kernel's interfaces, and filesystems in memory
+// or layered on top of others.  They're left out of discovery unless "mount-fs-types" asks for them.
+var pseudoFSTypes = map[string]bool{
+	"autofs":      true,
+	"binfmt_misc": true,
+	"bpf":         true,
+	"cgroup":      true,
+	"cgroup2":     true,
+	"configfs":    true,
+	"debugfs":     true,
+	"devpts":      true,
+	"devtmpfs":    true,
+	"efivarfs":    true,
+	"fusectl":     true,
+	"hugetlbfs":   true,
+	"mqueue":      true,
+	"nsfs":        true,
+	"overlay":     true,
+	"proc":        true,
+	"pstore":      true,
+	"ramfs":       true,
+	"rpc_pipefs":  true,
+	"securityfs":  true,
+	"selinuxfs":   true,
+	"squashfs":    true,
+	"sysfs":       true,
+	"tmpfs":       true,
+	"tracefs":     true,
+}
+
+// discoverMounts lists the mounts whose filesystem type is in fsTypes and whose mount point matches one of the patterns.
+// An empty fsTypes matches every type except the pseudo filesystems; empty patterns match every mount point.
+func discoverMounts(mounts []mountInfo, fsTypes []string, patterns []string) (dirs []monitoredDir, e error) {
+	isType := make(map[string]bool)
+	for _, fsType := range fsTypes {
+		isType[fsType] = true
+	}
+	for _, pattern := range patterns {
+		if _, matchErr := doublestar.Match(pattern, ""); matchErr != nil {
+			e = fmt.Errorf("Invalid mount-point pattern <%s>: %v", pattern, matchErr)
+			return
+		}
+	}
+
+	for _, mount := range mounts {
+		if len(isType) > 0 && !isType[mount.fsType] {
+			continue
+		}
+		if len(isType) == 0 && pseudoFSTypes[mount.fsType] {
+			continue
+		}
+		matched := len(patterns) == 0
+		for _, pattern := range patterns {
+			if matched, _ = doublestar.Match(pattern, mount.mountPoint); matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		dirs = append(dirs, monitoredDir{
+			path:       mount.mountPoint,
+			name:       nameFromPath(mount.mountPoint),
+			mountPoint: mount.mountPoint,
+			device:     mount.device,
+			fsType:     mount.fsType,
+		})
+	}
+	return
+}
+
+// loadDirectories puts together the directories to monitor from the "directories" and "where-to-look" lists,
+// and, if "discover-mounts" is set, the mounts from the mountinfo file.
+func loadDirectories() (dirs []monitoredDir, e error) {
+	var configs []directoryConfig
+	if e = viper.UnmarshalKey("directories", &configs); e != nil {
+		return
+	}
+	dirs, e = makeDirectories(configs, viper.GetStringSlice("where-to-look"))
+	return
+}
+
+// makeDirectories puts together the directories to monitor from explicitly-named directories, directories named by their
+// last path component, and, if "discover-mounts" is set, the mounts from the mountinfo file.  Alert names have to be unique.
+func makeDirectories(configs []directoryConfig, whereToLook []string) (dirs []monitoredDir, e error) {
+	mounts, mountsErr := readMountInfo(viper.GetString("mountinfo-path"))
+	if mountsErr != nil {
+		if viper.GetBool("discover-mounts") {
+			e = fmt.Errorf("Unable to read the mounts: %v", mountsErr)
+			return
+		}
+		// the mounts are only needed to fill in the devices and filesystem types
+		logging.Log.Warningf("Unable to read the mounts: %v", mountsErr)
+	}
+
+	for _, config := range configs {
+		dir := monitoredDir{path: filepath.Clean(config.Dir), name: config.Name}
+		if dir.name == "" {
+			dir.name = nameFromPath(dir.path)
+		}
+		dirs = append(dirs, dir)
+	}
+	for _, path := range whereToLook {
+		path = filepath.Clean(path)
+		pathParts := strings.Split(path, "/")
+		dirs = append(dirs, monitoredDir{path: path, name: pathParts[len(pathParts)-1]})
+	}
+	// a directory that's listed more than once is only monitored once, under the first of its names;
+	// otherwise the duplicates would share the same probes
+	nameOfPath := make(map[string]string)
+	uniqueDirs := dirs[:0]
+	for _, dir := range dirs {
+		if name, isListed := nameOfPath[dir.path]; isListed {
+			logging.Log.Warningf("<%s> is listed more than once; it will be monitored as <%s>", dir.path, name)
+			continue
+		}
+		nameOfPath[dir.path] = dir.name
+		uniqueDirs = append(uniqueDirs, dir)
+	}
+	dirs = uniqueDirs
+	for iDir := range dirs {
+		if mount, found := findMount(dirs[iDir].path, mounts); found {
+			dirs[iDir].mountPoint = mount.mountPoint
+			dirs[iDir].device = mount.device
+			dirs[iDir].fsType = mount.fsType
+		}
+	}
+
+	if viper.GetBool("discover-mounts") {
+		discovered, discoverErr := discoverMounts(mounts, viper.GetStringSlice("mount-fs-types"), viper.GetStringSlice("mount-points"))
+		if discoverErr != nil {
+			e = discoverErr
+			return
+		}
+		for _, dir := range discovered {
+			if _, isListed := nameOfPath[dir.path]; isListed {
+				continue
+			}
+			logging.Log.Noticef("Discovered <%s> (%s on %s)", dir.path, dir.fsType, dir.device)
+			nameOfPath[dir.path] = dir.name
+			dirs = append(dirs, dir)
+		}
+	}
+
+	pathOfName := make(map[string]string)
+	for _, dir := range dirs {
+		if otherPath, isTaken := pathOfName[dir.name]; isTaken {
+			e = fmt.Errorf("<%s> and <%s> would both send alerts as <%s>; give them distinct names in \"directories\"", otherPath, dir.path, dir.name)
+			return
+		}
+		pathOfName[dir.name] = dir.path
+	}
+	return
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+	"github.com/project8/swarm/Go/utility"
+)
+
+// handleRequest answers a dripline request sent to the queue:
+//   - get reading: the latest reading of the directory given by "dir" or "name" in the payload, or of every directory
+//   - get wait-interval, get directories: the current settings
+//   - set wait-interval: a duration (e.g. "30s") or a number of seconds
+//   - set directories: a list of paths, or of maps with "dir" and optionally "name", as in the "directories" configuration
+//   - cmd scan: read every directory now, and reply with the readings
+//
+// Set values are given as "values" (a list with one element) or "value" in the payload.
+func (m *monitor) handleRequest(request dripline.Request, queueName string) (e error) {
+	var instruction string
+	if request.Message.Target != queueName {
+		instruction = strings.TrimPrefix(request.Message.Target, queueName+".")
+	}
+
+	var retCode dripline.MsgCodeT
+	var msgText string
+	var result interface{}
+	switch request.MsgOp {
+	case dripline.MOGet:
+		logging.Log.Debugf("Get instruction: %s", instruction)
+		retCode, msgText, result = m.get(instruction, request.Message.Payload)
+	case dripline.MOSet:
+		logging.Log.Debugf("Set instruction: %s", instruction)
+		retCode, msgText, result = m.set(instruction, request.Message.Payload)
+	case dripline.MOCommand:
+		logging.Log.Debugf("Command instruction: %s", instruction)
+		retCode, msgText, result = m.command(instruction)
+	default:
+		retCode, msgText = dripline.RCErrDripMethod, "Incoming request operation type not handled: "+strconv.FormatUint(uint64(request.MsgOp), 10)
+	}
+	sendLock.Lock()
+	e = utility.PrepareAndSendReplyWithPayload(m.service, request, retCode, msgText, result, MasterSenderInfo)
+	sendLock.Unlock()
+	return
+}
+
+func (m *monitor) get(instruction string, payload interface{}) (retCode dripline.MsgCodeT, msgText string, result interface{}) {
+	switch instruction {
+	case "reading":
+		payloadAsMap, mapErr := payloadMap(payload)
+		if mapErr != nil {
+			return dripline.RCErrDripPayload, mapErr.Error(), nil
+		}
+		path, pathErr := payloadString(payloadAsMap, "dir")
+		if pathErr != nil {
+			return dripline.RCErrDripValue, pathErr.Error(), nil
+		}
+		name, nameErr := payloadString(payloadAsMap, "name")
+		if nameErr != nil {
+			return dripline.RCErrDripValue, nameErr.Error(), nil
+		}
+		dirs := m.currentDirs()
+		if path == "" && name == "" {
+			readings := make(map[string]interface{})
+			for _, dir := range dirs {
+				readings[dir.name] = m.readingPayload(dir)
+			}
+			return dripline.RCSuccess, fmt.Sprintf("Readings of %d directories", len(dirs)), readings
+		}
+		path = strings.TrimSuffix(path, "/")
+		for _, dir := range dirs {
+			if (path != "" && dir.path == path) || (name != "" && dir.name == name) {
+				return dripline.RCSuccess, fmt.Sprintf("Reading of <%s>", dir.path), m.readingPayload(dir)
+			}
+		}
+		if path == "" {
+			path = name
+		}
+		return dripline.RCErrDripValue, fmt.Sprintf("Not a directory being monitored: <%s>", path), nil
+	case "wait-interval":
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		return dripline.RCSuccess, fmt.Sprintf("Wait interval: %v", m.waitInterval), m.waitInterval.String()
+	case "directories":
+		var listing []interface{}
+		for _, dir := range m.currentDirs() {
+			listing = append(listing, map[string]interface{}{
+				"dir":         dir.path,
+				"name":        dir.name,
+				"mount_point": dir.mountPoint,
+				"device":      dir.device,
+				"fs_type":     dir.fsType,
+				"alerts_key":  dir.alertsKey,
+			})
+		}
+		return dripline.RCSuccess, fmt.Sprintf("%d directories being monitored", len(listing)), listing
+	}
+	return dripline.RCErrDripMethod, "Incoming request operation instruction not handled: " + instruction, nil
+}
+
+func (m *monitor) set(instruction string, payload interface{}) (retCode dripline.MsgCodeT, msgText string, result interface{}) {
+	value, valueErr := setValue(payload)
+	if valueErr != nil {
+		return dripline.RCErrDripPayload, valueErr.Error(), nil
+	}
+
+	switch instruction {
+	case "wait-interval":
+		var waitInterval time.Duration
+		if text, convErr := utility.TryConvertToString(value); convErr == nil {
+			var parseErr error
+			if waitInterval, parseErr = time.ParseDuration(text); parseErr != nil {
+				return dripline.RCErrDripValue, fmt.Sprintf("Invalid wait interval <%s>: %v", text, parseErr), nil
+			}
+		} else {
+			seconds, isNumber := toFloat(value)
+			if !isNumber {
+				return dripline.RCErrDripValue, fmt.Sprintf("Invalid wait interval <%v>: should be a duration or a number of seconds", value), nil
+			}
+			waitInterval = time.Duration(seconds * float64(time.Second))
+		}
+		if waitInterval <= 0 {
+			return dripline.RCErrDripValue, fmt.Sprintf("Invalid wait interval <%v>: should be positive", waitInterval), nil
+		}
+		m.setWaitInterval(waitInterval)
+		logging.Log.Noticef("Wait interval changed to %v", waitInterval)
+		return dripline.RCSuccess, fmt.Sprintf("Wait interval set to %v", waitInterval), waitInterval.String()
+	case "directories":
+		list, isList := value.([]interface{})
+		if !isList {
+			return dripline.RCErrDripValue, "The directories should be a list", nil
+		}
+		var configs []directoryConfig
+		for _, item := range list {
+			var config directoryConfig
+			if path, convErr := utility.TryConvertToString(item); convErr == nil {
+				config.Dir = path
+			} else {
+				itemAsMap, mapErr := payloadMap(item)
+				if mapErr != nil {
+					return dripline.RCErrDripValue, fmt.Sprintf("Invalid directory <%v>: should be a path or a map with \"dir\" and \"name\"", item), nil
+				}
+				var itemErr error
+				if config.Dir, itemErr = payloadString(itemAsMap, "dir"); itemErr != nil {
+					return dripline.RCErrDripValue, itemErr.Error(), nil
+				}
+				if config.Name, itemErr = payloadString(itemAsMap, "name"); itemErr != nil {
+					return dripline.RCErrDripValue, itemErr.Error(), nil
+				}
+			}
+			if config.Dir == "" {
+				return dripline.RCErrDripValue, fmt.Sprintf("Invalid directory <%v>: no path", item), nil
+			}
+			configs = append(configs, config)
+		}
+		if len(configs) == 0 {
+			return dripline.RCErrDripValue, "No directories were provided", nil
+		}
+		dirs, dirsErr := makeDirectories(configs, nil)
+		if dirsErr != nil {
+			return dripline.RCErrDripValue, dirsErr.Error(), nil
+		}
+		if setErr := m.setDirectories(dirs); setErr != nil {
+			return dripline.RCErrDripValue, setErr.Error(), nil
+		}
+		logging.Log.Noticef("Directory list changed; %d directories are being monitored", len(dirs))
+		return dripline.RCSuccess, fmt.Sprintf("%d directories are being monitored", len(dirs)), nil
+	}
+	return dripline.RCErrDripMethod, "Incoming request operation instruction not handled: " + instruction, nil
+}
+
+func (m *monitor) command(instruction string) (retCode dripline.MsgCodeT, msgText string, result interface{}) {
+	switch instruction {
+	case "scan":
+		logging.Log.Notice("Scan requested")
+		m.scan()
+		return m.get("reading", nil)
+	}
+	return dripline.RCErrDripMethod, "Incoming request operation instruction not handled: " + instruction, nil
+}
+
+// payloadMap converts a request payload, which may be missing, to a map
+func payloadMap(payload interface{}) (payloadAsMap map[interface{}]interface{}, e error) {
+	switch typedPayload := payload.(type) {
+	case nil:
+		payloadAsMap = make(map[interface{}]interface{})
+	case map[interface{}]interface{}:
+		payloadAsMap = typedPayload
+	case map[string]interface{}:
+		payloadAsMap = make(map[interface{}]interface{})
+		for key, value := range typedPayload {
+			payloadAsMap[key] = value
+		}
+	default:
+		e = fmt.Errorf("Unable to convert payload to map; aborting message")
+	}
+	return
+}
+
+// payloadString gets a string from a payload map, which may have been decoded as bytes; a missing key gives an empty string
+func payloadString(payloadAsMap map[interface{}]interface{}, key string) (value string, e error) {
+	ifcValue, present := payloadAsMap[key]
+	if !present || ifcValue == nil {
+		return
+	}
+	if value, e = utility.TryConvertToString(ifcValue); e != nil {
+		e = fmt.Errorf("Unable to convert \"%s\" to a string", key)
+	}
+	return
+}
+
+// setValue gets the value of a set request from the payload
+func setValue(payload interface{}) (value interface{}, e error) {
+	payloadAsMap, mapErr := payloadMap(payload)
+	if mapErr != nil {
+		e = mapErr
+		return
+	}
+	if values, hasValues := payloadAsMap["values"]; hasValues {
+		valueList, isList := values.([]interface{})
+		if !isList || len(valueList) != 1 {
+			e = fmt.Errorf("\"values\" should be a list with one element")
+			return
+		}
+		value = valueList[0]
+		return
+	}
+	value, hasValue := payloadAsMap["value"]
+	if !hasValue {
+		e = fmt.Errorf("No value present in message; aborting")
+	}
+	return
+}
+
+// toFloat converts any of the number types a payload can be decoded to
+func toFloat(value interface{}) (number float64, ok bool) {
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflected.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflected.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float(), true
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/kardianos/osext"
+	"github.com/spf13/viper"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/authentication"
+	"github.com/project8/swarm/Go/logging"
+	"github.com/project8/swarm/Go/utility"
+)
+
+// Kinds of removal
+const (
+	removalEmptyDir  = "empty directory"
+	removalFileRule  = "file rule"
+	removalRetention = "retention"
+)
+
+var MasterSenderInfo dripline.SenderInfo
+
+func fillMasterSenderInfo() (e error) {
+	MasterSenderInfo.Package = "dungbeetle"
+	MasterSenderInfo.Exe, e = osext.Executable()
+	if e != nil {
+		return
+	}
+
+	MasterSenderInfo.Hostname, e = os.Hostname()
+	if e != nil {
+		return
+	}
+
+	user, userErr := user.Current()
+	e = userErr
+	if e != nil {
+		return
+	}
+	MasterSenderInfo.Username = user.Username
+	return
+}
+
+// activityNotifier publishes dripline alerts about what dungbeetle does.
+// The methods are safe to call on a nil notifier, in which case nothing is sent,
+// and from the goroutines sweeping different roots.
+type activityNotifier struct {
+	lock       sync.Mutex
+	service    *dripline.AmqpService
+	sweepKey   string
+	removalKey string
+}
+
+// startActivityNotifier connects to the broker with the AMQP credentials from the authentication file
+func startActivityNotifier() (n *activityNotifier, e error) {
+	if authErr := authentication.Load(); authErr != nil {
+		e = authErr
+		return
+	}
+	if !authentication.AmqpAvailable() {
+		e = errors.New("Authentication for AMQP is not available")
+		return
+	}
+	url := "amqp://" + authentication.AmqpUsername() + ":" + authentication.AmqpPassword() + "@" + viper.GetString("broker")
+
+	// the queue name and routing keys are templates; see utility.ExpandTemplate
+	hostVars, hostErr := utility.HostVariables()
+	if hostErr != nil {
+		e = hostErr
+		return
+	}
+	queueName, queueErr := utility.ExpandTemplate(viper.GetString("subscribe-queue"), hostVars)
+	if queueErr != nil {
+		e = queueErr
+		return
+	}
+	n = &activityNotifier{}
+	if n.sweepKey, e = utility.ExpandTemplate(viper.GetString("sweep-alert-key"), hostVars); e != nil {
+		return
+	}
+	if n.removalKey, e = utility.ExpandTemplate(viper.GetString("removal-alert-key"), hostVars); e != nil {
+		return
+	}
+
+	service := dripline.StartService(url, queueName)
+	if service == nil {
+		e = errors.New("AMQP service did not start")
+		return
+	}
+	logging.Log.Info("AMQP service started")
+
+	if e = fillMasterSenderInfo(); e != nil {
+		return
+	}
+
+	n.service = service
+	logging.Log.Noticef("Sweep summaries will be sent to <%s>", n.sweepKey)
+	if n.removalKey != "" {
+		logging.Log.Noticef("Removals will be sent to <%s>", n.removalKey)
+	}
+	return
+}
+
+func (n *activityNotifier) send(routingKey string, payload map[string]interface{}) {
+	alert := dripline.PrepareAlert(routingKey, "application/json", MasterSenderInfo)
+	alert.Message.Payload = payload
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if sendErr := n.service.SendAlert(alert); sendErr != nil {
+		logging.Log.Errorf("Could not send the alert to <%s>: %v", routingKey, sendErr)
+	}
+}
+
+// publishRemoval sends an alert about one removed (or archived) file or directory
+func (n *activityNotifier) publishRemoval(root string, path string, kind string, action string, size int64, modTime time.Time) {
+	if n == nil || n.removalKey == "" {
+		return
+	}
+	payload := make(map[string]interface{})
+	payload["root"] = root
+	payload["path"] = path
+	payload["kind"] = kind
+	payload["action"] = action
+	payload["bytes"] = size
+	payload["age_seconds"] = time.Since(modTime).Seconds()
+	n.send(n.removalKey, payload)
+}
+
+// publishSweep sends the counts for a sweep of all of the roots
+func (n *activityNotifier) publishSweep(summary *sweepSummary) {
+	if n == nil {
+		return
+	}
+	var nRemoved, nSkipped, nErrors int
+	var nBytes int64
+	roots := make(map[string]interface{})
+	for _, rs := range summary.roots {
+		rootPayload := make(map[string]interface{})
+		rootPayload["items_removed"] = rs.nRemoved
+		rootPayload["skipped"] = rs.nSkipped
+		rootPayload["errors"] = len(rs.errors)
+		rootPayload["bytes_reclaimed"] = rs.nBytes
+		rootPayload["aborted"] = rs.aborted
+		rootPayload["stalled"] = rs.stalled
+		roots[rs.root] = rootPayload
+
+		nRemoved += rs.nRemoved
+		nSkipped += rs.nSkipped
+		nErrors += len(rs.errors)
+		nBytes += rs.nBytes
+	}
+
+	payload := make(map[string]interface{})
+	payload["items_removed"] = nRemoved
+	payload["skipped"] = nSkipped
+	payload["errors"] = nErrors
+	payload["bytes_reclaimed"] = nBytes
+	payload["stalled"] = summary.nStalled()
+	payload["interrupted"] = summary.interrupted
+	payload["duration_seconds"] = summary.duration.Seconds()
+	payload["roots"] = roots
+	n.send(n.sweepKey, payload)
+	logging.Log.Infof("Sweep alert sent: %d items removed, %d skipped, %d errors, %d bytes reclaimed", nRemoved, nSkipped, nErrors, nBytes)
+}
+
+// recordRemoval counts a removal in the root's sweep and publishes it.
+// Archived or moved items still take up space, so only deletions and compression count towards the bytes reclaimed.
+func (s *sweeper) recordRemoval(rs *rootSweep, path string, kind string, action string, size int64, modTime time.Time) {
+	if action == actionDelete || action == actionCompress {
+		rs.nBytes += size
+	}
+	s.notifier.publishRemoval(rs.root, path, kind, action, size, modTime)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Archive modes
+const (
+	archiveTrash   = "trash"
+	archiveTarball = "tarball"
+)
+
+// archiveDateFormat names the per-day trash directories and bundles
+const archiveDateFormat = "2006-01-02"
+
+const tarballSuffix = ".tar.gz"
+
+// archiveConfig is the configuration form of a root's archive
+type archiveConfig struct {
+	Root      string        `mapstructure:"root"`
+	Mode      string        `mapstructure:"mode"`
+	Dir       string        `mapstructure:"dir"`
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// archive keeps what dungbeetle would otherwise delete from a root.
+// In "trash" mode, things are moved to <dir>/<date>/<path relative to the root>;
+// in "tarball" mode, they're appended to the day's bundle, <dir>/<date>.tar.gz.
+// Each day's trash directory or bundle is purged once the day is older than the retention period.
+type archive struct {
+	root string
+	mode string
+	dir  string
+	// 0 means the archive is never purged
+	retention time.Duration
+
+	// how much of the bundle named checkedBundle is known to be complete gzip members;
+	// shared by the sweeps and the watcher, which can add to the same bundle
+	checkLock     sync.Mutex
+	checkedBundle string
+	checkedSize   int64
+}
+
+// loadArchives reads the "archive" configuration, keyed by root directory.
+// The archive directory defaults to a sibling of the root named <root>-archive.
+func loadArchives(rootDirs []string) (archives map[string]*archive, e error) {
+	archives = make(map[string]*archive)
+	isRoot := make(map[string]bool)
+	for _, rootDir := range rootDirs {
+		isRoot[rootDir] = true
+	}
+
+	var configs []archiveConfig
+	if e = viper.UnmarshalKey("archive", &configs); e != nil {
+		return
+	}
+	archiveDirs := make(map[string]string)
+	for _, config := range configs {
+		theArchive := &archive{
+			mode:      config.Mode,
+			retention: config.Retention,
+		}
+
+		var absErr error
+		if theArchive.root, absErr = filepath.Abs(filepath.Clean(config.Root)); absErr != nil || !isRoot[theArchive.root] {
+			e = fmt.Errorf("Archive for <%s> must have a root that is one of the root directories", config.Root)
+			return
+		}
+		if _, isDuplicate := archives[theArchive.root]; isDuplicate {
+			e = fmt.Errorf("There is more than one archive for <%s>", theArchive.root)
+			return
+		}
+
+		if theArchive.mode == "" {
+			theArchive.mode = archiveTrash
+		}
+		if theArchive.mode != archiveTrash && theArchive.mode != archiveTarball {
+			e = fmt.Errorf("Archive for <%s> has unknown mode <%s>; options are \"trash\" and \"tarball\"", theArchive.root, theArchive.mode)
+			return
+		}
+		if theArchive.retention < 0 {
+			e = fmt.Errorf("Archive for <%s> has a negative retention period", theArchive.root)
+			return
+		}
+
+		archiveDir := config.Dir
+		if archiveDir == "" {
+			archiveDir = theArchive.root + "-archive"
+		}
+		if theArchive.dir, absErr = filepath.Abs(filepath.Clean(archiveDir)); absErr != nil {
+			e = fmt.Errorf("Unable to get absolute form of the archive directory <%s>", archiveDir)
+			return
+		}
+		// an archive inside a root directory would itself be swept
+		for _, rootDir := range rootDirs {
+			if theArchive.dir == rootDir || strings.HasPrefix(theArchive.dir, rootDir+string(os.PathSeparator)) {
+				e = fmt.Errorf("Archive directory <%s> must not be inside root directory <%s>", theArchive.dir, rootDir)
+				return
+			}
+		}
+		if otherRoot, isShared := archiveDirs[theArchive.dir]; isShared {
+			e = fmt.Errorf("Archive directory <%s> is used for both <%s> and <%s>", theArchive.dir, otherRoot, theArchive.root)
+			return
+		}
+		archiveDirs[theArchive.dir] = theArchive.root
+
+		archives[theArchive.root] = theArchive
+		if theArchive.retention > 0 {
+			logging.Log.Noticef("Archiving from <%s> to <%s> (%s); archives are purged after %v", theArchive.root, theArchive.dir, theArchive.mode, theArchive.retention)
+		} else {
+			logging.Log.Noticef("Archiving from <%s> to <%s> (%s); archives are kept indefinitely", theArchive.root, theArchive.dir, theArchive.mode)
+		}
+	}
+	return
+}
+
+// store moves a file or directory (and everything below it) into the archive; in "tarball" mode, it goes into the day's bundle
+func (a *archive) store(path string, info os.FileInfo, rs *rootSweep) (e error) {
+	switch a.mode {
+	case archiveTrash:
+		dayDir := filepath.Join(a.dir, time.Now().Format(archiveDateFormat))
+		if info.IsDir() {
+			e = moveTree(path, a.root, dayDir)
+		} else {
+			e = moveToTrash(path, a.root, dayDir)
+		}
+		if e == nil {
+			logging.Log.Debugf("Moved <%s> to <%s>", path, dayDir)
+		}
+	case archiveTarball:
+		// a sweep that runs past midnight moves on to the next day's bundle
+		if rs.bundle != nil && rs.bundle.day != time.Now().Format(archiveDateFormat) {
+			rs.closeBundle()
+		}
+		if rs.bundle == nil {
+			if rs.bundle, e = a.openBundle(); e != nil {
+				return
+			}
+		}
+		if e = rs.bundle.add(a, path); e != nil {
+			return
+		}
+		logging.Log.Debugf("Added <%s> to <%s>", path, rs.bundle.name)
+		e = os.RemoveAll(path)
+	}
+	return
+}
+
+// bundle is the day's tar.gz file in "tarball" mode, which every sweep (and the watcher) appends to.
+// Each file or directory is written as a gzip member of its own, and synced before the original is removed,
+// so a failure or a crash loses at most the one being added; whatever was written of it is cut off again
+// before anything else is appended. Appends are serialized with a lock on the file.
+// There's no end-of-archive marker, which would hide anything appended after it; tar reads to the end of the file instead.
+type bundle struct {
+	name string
+	day  string
+	file *os.File
+}
+
+// openBundle opens the current day's bundle, creating it if need be
+func (a *archive) openBundle() (b *bundle, e error) {
+	if e = os.MkdirAll(a.dir, os.ModeDir|0775); e != nil {
+		return
+	}
+	day := time.Now().Format(archiveDateFormat)
+	bundleName := filepath.Join(a.dir, day+tarballSuffix)
+	bundleFile, openErr := os.OpenFile(bundleName, os.O_RDWR|os.O_CREATE, 0664)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	logging.Log.Debugf("Opened bundle <%s>", bundleName)
+	b = &bundle{name: bundleName, day: day, file: bundleFile}
+	return
+}
+
+// add appends path and everything below it to the bundle
+func (b *bundle) add(a *archive, path string) (e error) {
+	fd := int(b.file.Fd())
+	if e = syscall.Flock(fd, syscall.LOCK_EX); e != nil {
+		return
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+
+	var size int64
+	if size, e = b.checkEnd(a); e != nil {
+		return
+	}
+	gzWriter := gzip.NewWriter(b.file)
+	tarWriter := tar.NewWriter(gzWriter)
+	e = a.writeTree(path, tarWriter)
+	if e == nil {
+		e = tarWriter.Flush()
+	}
+	if e == nil {
+		e = gzWriter.Close()
+	}
+	if e == nil {
+		e = b.file.Sync()
+	}
+	if e == nil {
+		var newSize int64
+		if newSize, e = b.file.Seek(0, io.SeekCurrent); e == nil {
+			a.setChecked(b.name, newSize)
+			return
+		}
+	}
+	if cutErr := b.file.Truncate(size); cutErr != nil {
+		logging.Log.Errorf("Unable to cut off a partial entry in bundle <%s>: %v", b.name, cutErr)
+		a.setChecked(b.name, 0)
+	}
+	return
+}
+
+// checkEnd makes sure that the bundle ends with a complete gzip member, cutting off what's left of one that a crash interrupted,
+// and leaves the file positioned at the end.
+// Only what was appended since the archive last looked at the bundle is read.
+func (b *bundle) checkEnd(a *archive) (size int64, e error) {
+	if size, e = b.file.Seek(0, io.SeekEnd); e != nil {
+		return
+	}
+	checked := a.getChecked(b.name)
+	if checked == size {
+		return
+	}
+	if checked > size {
+		checked = 0
+	}
+	complete, readErr := completeMembers(b.file, checked)
+	if complete < size {
+		logging.Log.Warningf("Cutting off an incomplete entry at the end of bundle <%s>: %v", b.name, readErr)
+		if e = b.file.Truncate(complete); e != nil {
+			return
+		}
+		size = complete
+	}
+	a.setChecked(b.name, size)
+	_, e = b.file.Seek(size, io.SeekStart)
+	return
+}
+
+func (a *archive) getChecked(bundleName string) int64 {
+	a.checkLock.Lock()
+	defer a.checkLock.Unlock()
+	if a.checkedBundle != bundleName {
+		return 0
+	}
+	return a.checkedSize
+}
+
+func (a *archive) setChecked(bundleName string, size int64) {
+	a.checkLock.Lock()
+	defer a.checkLock.Unlock()
+	a.checkedBundle = bundleName
+	a.checkedSize = size
+}
+
+// completeMembers reads the gzip members in a file from an offset, and returns where the last complete one ends,
+// along with the error that stopped it before the end of the file, if there was one
+func completeMembers(file *os.File, from int64) (end int64, e error) {
+	end = from
+	if _, e = file.Seek(from, io.SeekStart); e != nil {
+		return
+	}
+	// gzip reads from an io.ByteReader without buffering ahead, so the count lands exactly on the end of each member
+	counter := &countingReader{reader: bufio.NewReader(file)}
+	gzReader := new(gzip.Reader)
+	for {
+		if e = gzReader.Reset(counter); e != nil {
+			if e == io.EOF && from+counter.n == end {
+				e = nil
+			}
+			return
+		}
+		gzReader.Multistream(false)
+		if _, e = io.Copy(ioutil.Discard, gzReader); e != nil {
+			return
+		}
+		end = from + counter.n
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader *bufio.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, e error) {
+	n, e = c.reader.Read(p)
+	c.n += int64(n)
+	return
+}
+
+func (c *countingReader) ReadByte() (b byte, e error) {
+	if b, e = c.reader.ReadByte(); e == nil {
+		c.n++
+	}
+	return
+}
+
+// close closes the bundle; everything added to it has already been synced
+func (b *bundle) close() error {
+	return b.file.Close()
+}
+
+// writeTree adds path and everything below it to the tar stream, named relative to the root
+func (a *archive) writeTree(path string, tarWriter *tar.Writer) error {
+	return filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, relErr := filepath.Rel(a.root, walkPath)
+		if relErr != nil {
+			return relErr
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			var linkErr error
+			if link, linkErr = os.Readlink(walkPath); linkErr != nil {
+				return linkErr
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			logging.Log.Warningf("Not archiving special file <%s>", walkPath)
+			return nil
+		}
+		header, headerErr := tar.FileInfoHeader(info, link)
+		if headerErr != nil {
+			return headerErr
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if writeErr := tarWriter.WriteHeader(header); writeErr != nil {
+			return writeErr
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, openErr := os.Open(walkPath)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		_, copyErr := io.Copy(tarWriter, file)
+		return copyErr
+	})
+}
+
+// purge removes the trash directories and bundles from days that ended longer ago than the retention period
+func (a *archive) purge(dryRun bool, rs *rootSweep) {
+	if a.retention == 0 {
+		return
+	}
+	archiveContents, readDirErr := ioutil.ReadDir(a.dir)
+	if readDirErr != nil {
+		if !os.IsNotExist(readDirErr) {
+			logging.Log.Errorf("Unable to read archive directory <%s>: %v", a.dir, readDirErr)
+			rs.addError(a.dir, readDirErr)
+		}
+		return
+	}
+	for _, fileInfo := range archiveContents {
+		dayName := fileInfo.Name()
+		if a.mode == archiveTarball {
+			if fileInfo.IsDir() || !strings.HasSuffix(dayName, tarballSuffix) {
+				continue
+			}
+			dayName = strings.TrimSuffix(dayName, tarballSuffix)
+		} else if !fileInfo.IsDir() {
+			continue
+		}
+		day, parseErr := time.ParseInLocation(archiveDateFormat, dayName, time.Local)
+		if parseErr != nil {
+			logging.Log.Debugf("Leaving <%s> in the archive directory alone", fileInfo.Name())
+			continue
+		}
+		if time.Since(day.AddDate(0, 0, 1)) <= a.retention {
+			continue
+		}
+
+		archiveName := filepath.Join(a.dir, fileInfo.Name())
+		if dryRun {
+			logging.Log.Infof("Would purge archive <%s>", archiveName)
+			continue
+		}
+		if remErr := os.RemoveAll(archiveName); remErr != nil {
+			logging.Log.Errorf("Unable to purge archive <%s>: %v", archiveName, remErr)
+			rs.addError(archiveName, remErr)
+			continue
+		}
+		logging.Log.Infof("Purged archive <%s>", archiveName)
+	}
+}
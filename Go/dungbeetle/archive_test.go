@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBundleAppend archives files in separate sweeps, with the remains of an interrupted entry in between,
+// and checks that everything ends up readable in the day's bundle
+func TestBundleAppend(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "dungbeetle")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "root")
+	theArchive := &archive{root: root, mode: archiveTarball, dir: root + "-archive"}
+	bundleName := filepath.Join(theArchive.dir, time.Now().Format(archiveDateFormat)+tarballSuffix)
+
+	archiveFile := func(name string) {
+		path := filepath.Join(root, name)
+		if writeErr := ioutil.WriteFile(path, []byte(name), 0644); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		info, statErr := os.Lstat(path)
+		if statErr != nil {
+			t.Fatal(statErr)
+		}
+		rs := &rootSweep{root: root, archive: theArchive}
+		if storeErr := theArchive.store(path, info, rs); storeErr != nil {
+			t.Fatalf("Unable to archive <%s>: %v", name, storeErr)
+		}
+		rs.closeBundle()
+		if len(rs.errors) != 0 {
+			t.Fatalf("Errors closing the bundle: %v", rs.errors)
+		}
+		if _, statErr = os.Lstat(path); !os.IsNotExist(statErr) {
+			t.Errorf("<%s> is still in the root", name)
+		}
+	}
+
+	if mkdirErr := os.Mkdir(root, 0755); mkdirErr != nil {
+		t.Fatal(mkdirErr)
+	}
+	archiveFile("first")
+	archiveFile("second")
+
+	// a crash part way through adding an entry leaves the start of a gzip member at the end
+	bundleFile, openErr := os.OpenFile(bundleName, os.O_WRONLY|os.O_APPEND, 0)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	gzWriter := gzip.NewWriter(bundleFile)
+	gzWriter.Write([]byte("interrupted"))
+	gzWriter.Flush()
+	bundleFile.Close()
+	// and a new process doesn't know how much of the bundle it has already checked
+	theArchive = &archive{root: root, mode: archiveTarball, dir: root + "-archive"}
+	archiveFile("third")
+
+	bundles, globErr := filepath.Glob(filepath.Join(theArchive.dir, "*"))
+	if globErr != nil || len(bundles) != 1 || bundles[0] != bundleName {
+		t.Fatalf("Expected only the bundle <%s>, found %v", bundleName, bundles)
+	}
+	bundleFile, openErr = os.Open(bundleName)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer bundleFile.Close()
+	gzReader, gzErr := gzip.NewReader(bundleFile)
+	if gzErr != nil {
+		t.Fatal(gzErr)
+	}
+	tarReader := tar.NewReader(gzReader)
+	var names []string
+	for {
+		header, nextErr := tarReader.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			t.Fatalf("Unable to read the bundle after %v: %v", names, nextErr)
+		}
+		contents, readErr := ioutil.ReadAll(tarReader)
+		if readErr != nil || string(contents) != header.Name {
+			t.Errorf("Wrong contents for <%s>: %q (%v)", header.Name, contents, readErr)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 3 || names[0] != "first" || names[1] != "second" || names[2] != "third" {
+		t.Errorf("Expected first, second and third in the bundle, found %v", names)
+	}
+}
@@ -5,65 +5,352 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 
 	"github.com/project8/swarm/Go/logging"
 )
 
-// processDir will remove empty directories older than maxAge, and recursively process children of non-empty directories
-func processDir(dirInfo os.FileInfo, basePath string, maxAge time.Duration, ignoreDirs map[string]bool) error {
+// Exit statuses
+const (
+	exitClean = 0
+	// something couldn't be started or configured, or dungbeetle was stopped abruptly
+	exitFatal = 1
+	// the last sweep had errors, or couldn't sweep every root
+	exitErrors = 2
+)
+
+// sweeper holds the settings used while processing directories
+type sweeper struct {
+	// the settings from here to rootTimeout can be replaced while running (see loadSettings()), so they're guarded by lock.
+	// Each root sweep takes a snapshot of them when it starts, except for the ignore rules, which are accessed with currentIgnoreRules().
+	lock   sync.RWMutex
+	maxAge time.Duration
+	ignore *ignoreRules
+	// file rules, keyed by root directory
+	fileRules map[string][]*fileRule
+	// retention policies, keyed by root directory
+	retention map[string]*retentionPolicy
+	// archives for what would otherwise be deleted, keyed by root directory
+	archives map[string]*archive
+	// maximum number of errors per root per sweep; 0 means no limit
+	maxErrors int
+	// how long a sweep waits for each root before reporting it as stalled; 0 means wait indefinitely
+	rootTimeout time.Duration
+
+	// in a dry run, nothing is removed
+	dryRun bool
+	// if report is not nil, every removal (or would-be removal in a dry run) and skipped directory is recorded
+	report *sweepReport
+	// if notifier is not nil, removals and sweep summaries are published as alerts
+	notifier *activityNotifier
+	// roots whose sweep is in progress
+	busy busyRoots
+	// closed when dungbeetle has been asked to stop; sweeps finish the directory they're in and return
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// loadSettings reads the reloadable settings from the configuration.
+// If any of them is invalid, none of them are changed.
+func (s *sweeper) loadSettings(rootDirs []string) (e error) {
+	ignore, ignoreErr := loadIgnoreRules()
+	if ignoreErr != nil {
+		e = fmt.Errorf("Unable to load the ignore list: %v", ignoreErr)
+		return
+	}
+	fileRules, rulesErr := loadFileRules(rootDirs)
+	if rulesErr != nil {
+		e = fmt.Errorf("Unable to load the file rules: %v", rulesErr)
+		return
+	}
+	retention, retentionErr := loadRetentionPolicies(rootDirs)
+	if retentionErr != nil {
+		e = fmt.Errorf("Unable to load the retention policies: %v", retentionErr)
+		return
+	}
+	archives, archivesErr := loadArchives(rootDirs)
+	if archivesErr != nil {
+		e = fmt.Errorf("Unable to load the archives: %v", archivesErr)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxAge = viper.GetDuration("maximum-age")
+	s.ignore = ignore
+	s.fileRules = fileRules
+	s.retention = retention
+	s.archives = archives
+	s.maxErrors = viper.GetInt("max-errors")
+	s.rootTimeout = viper.GetDuration("root-timeout")
+	return
+}
+
+// currentMaxAge returns the maximum age in effect
+func (s *sweeper) currentMaxAge() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.maxAge
+}
+
+// requestStop asks sweeps in progress to finish the directory they're in and return; it's safe to call more than once
+func (s *sweeper) requestStop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// stopRequested checks whether requestStop() has been called
+func (s *sweeper) stopRequested() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// processDir will remove empty directories older than maxAge, and recursively process children of non-empty directories.
+// Files in non-empty directories are checked against the rules.
+// Children are processed first, so a directory that's emptied by removing its children is removed in the same pass.
+// Its age is taken from its modification time before the children were removed, since removing them bumps it.
+// Errors are recorded in rs rather than returned, so that one bad path doesn't stop the rest of the root from being processed.
+// The return value says whether the directory was (or, in a dry run, would have been) removed.
+func (s *sweeper) processDir(dirInfo os.FileInfo, basePath string, rs *rootSweep) (removed bool) {
+	if rs.aborted || s.stopRequested() {
+		return
+	}
 	dirName := filepath.Join(basePath, dirInfo.Name())
 
 	cleanName, cleanErr := filepath.Abs(filepath.Clean(dirName))
 	if cleanErr != nil {
 		logging.Log.Errorf("Unable to clean directory <%s>: %v", dirName, cleanErr)
-		return cleanErr
+		rs.addError(dirName, cleanErr)
+		return
 	}
-	if _, doIgnore := ignoreDirs[cleanName]; doIgnore {
+	ignore := s.currentIgnoreRules()
+	if ignore.matches(rs.root, cleanName) {
 		logging.Log.Debugf("Ignoring directory <%s>", dirName)
-		return nil
+		s.report.addSkipped(cleanName, dirInfo.ModTime(), skipIgnored)
+		rs.nSkipped++
+		return
 	}
 
 	logging.Log.Debugf("Processing directory <%s>", dirName)
 	dirContents, readDirErr := ioutil.ReadDir(dirName)
 	if readDirErr != nil {
 		logging.Log.Errorf("Unable to read directory <%s>: %v", dirName, readDirErr)
-		return readDirErr
+		rs.addError(cleanName, readDirErr)
+		return
+	}
+	if ignore.hasMarker(dirContents) {
+		logging.Log.Debugf("Keeping directory <%s> and everything below it", dirName)
+		s.report.addSkipped(cleanName, dirInfo.ModTime(), skipKeepMarker)
+		rs.nSkipped++
+		return
 	}
-	if len(dirContents) == 0 {
 
-		// Directory is empty, check if we need to remove it
-		logging.Log.Debugf("Directory is empty; checking age")
-		if time.Since(dirInfo.ModTime()) > maxAge {
-			// Ok, then remove the directory
-			if remErr := os.Remove(dirName); remErr != nil {
-				logging.Log.Errorf("Unable to remove an empty directory <%s>: %v", dirName, remErr)
-				return remErr
+	if len(dirContents) != 0 {
+		// Directory is not empty; process its contents
+		logging.Log.Debugf("Directory <%s> is not empty; processing contents", dirName)
+		allRemoved := true
+		for _, fileInfo := range dirContents {
+			if rs.aborted || s.stopRequested() {
+				return
+			}
+			if fileInfo.IsDir() {
+				if !s.processDir(fileInfo, dirName, rs) {
+					allRemoved = false
+				}
+			} else if !s.processFile(fileInfo, dirName, rs) {
+				allRemoved = false
 			}
-			logging.Log.Infof("Successfully removed directory <%s>", dirName)
 		}
+		if !allRemoved {
+			s.report.addSkipped(cleanName, dirInfo.ModTime(), skipNotEmpty)
+			rs.nSkipped++
+			logging.Log.Debugf("No action taken on directory <%s>", dirName)
+			return
+		}
+		logging.Log.Debugf("Directory <%s> has been emptied", dirName)
+	}
 
+	// Directory is empty, check if we need to remove it
+	logging.Log.Debugf("Directory is empty; checking age")
+	if time.Since(dirInfo.ModTime()) <= rs.maxAge {
+		s.report.addSkipped(cleanName, dirInfo.ModTime(), skipTooYoung)
+		rs.nSkipped++
+		return
+	}
+	return s.removeEmpty(dirName, cleanName, dirInfo, rs)
+}
+
+// removeEmpty removes (or archives) an empty directory that's old enough, and records the removal in rs.
+// The return value says whether the directory was (or, in a dry run, would have been) removed.
+func (s *sweeper) removeEmpty(dirName string, cleanName string, dirInfo os.FileInfo, rs *rootSweep) (removed bool) {
+	if s.dryRun {
+		logging.Log.Infof("Would remove directory <%s>", dirName)
+		s.report.addRemoved(cleanName, dirInfo.ModTime())
+		rs.nRemoved++
+		return true
+	}
+	// Ok, then remove the directory; if something was added since it was read, this fails and the directory is kept
+	if remErr := s.removeEmptyDir(dirName, dirInfo, rs); remErr != nil {
+		if isNotEmpty(remErr) {
+			logging.Log.Debugf("Directory <%s> is no longer empty", dirName)
+			s.report.addSkipped(cleanName, dirInfo.ModTime(), skipNotEmpty)
+			rs.nSkipped++
+			return
+		}
+		logging.Log.Errorf("Unable to remove an empty directory <%s>: %v", dirName, remErr)
+		rs.addError(cleanName, remErr)
+		return
+	}
+	// an empty directory's own size is just its directory entries, not space that's worth reporting
+	if rs.archive != nil {
+		logging.Log.Infof("Successfully archived directory <%s>", dirName)
+		s.recordRemoval(rs, cleanName, removalEmptyDir, retentionArchive, 0, dirInfo.ModTime())
 	} else {
+		logging.Log.Infof("Successfully removed directory <%s>", dirName)
+		s.recordRemoval(rs, cleanName, removalEmptyDir, retentionDelete, 0, dirInfo.ModTime())
+	}
+	s.report.addRemoved(cleanName, dirInfo.ModTime())
+	rs.nRemoved++
+	return true
+}
 
-		// Directory is not empty; process its contents
-		for _, fileInfo := range dirContents {
-			logging.Log.Debugf("Directory <%s> is not empty; processing contents", dirName)
-			if fileInfo.IsDir() {
-				if procErr := processDir(fileInfo, dirName, maxAge, ignoreDirs); procErr != nil {
-					logging.Log.Errorf("An error occurred while processing directory <%s>: %v", fileInfo.Name(), procErr)
-					// pass errors back up through recursion chain
-					return procErr
-				}
-			} // else it's a file; ignore it
+// removeEmptyDir removes an empty directory, or moves it to the root's archive if it has one
+func (s *sweeper) removeEmptyDir(dirName string, dirInfo os.FileInfo, rs *rootSweep) error {
+	if rs.archive == nil {
+		return os.Remove(dirName)
+	}
+	dirContents, readDirErr := ioutil.ReadDir(dirName)
+	if readDirErr != nil {
+		return readDirErr
+	}
+	if len(dirContents) != 0 {
+		return &os.PathError{Op: "remove", Path: dirName, Err: syscall.ENOTEMPTY}
+	}
+	return rs.archive.store(dirName, dirInfo, rs)
+}
+
+// removeTree removes a file or directory tree, or moves it to the root's archive if it has one
+func (s *sweeper) removeTree(path string, info os.FileInfo, rs *rootSweep) error {
+	if rs.archive != nil {
+		return rs.archive.store(path, info, rs)
+	}
+	return os.RemoveAll(path)
+}
+
+// isNotEmpty checks whether an error from os.Remove is because the directory isn't empty
+func isNotEmpty(err error) bool {
+	if pathErr, isPathErr := err.(*os.PathError); isPathErr {
+		err = pathErr.Err
+	}
+	return err == syscall.ENOTEMPTY || err == syscall.EEXIST
+}
+
+// sweepRoot applies processDir() to the contents of one root directory
+func (s *sweeper) sweepRoot(rs *rootSweep) {
+	rootDir := rs.root
+	logging.Log.Debugf("Processing directory <%s>", rootDir)
+	defer rs.closeBundle()
+
+	if rs.archive != nil {
+		rs.archive.purge(s.dryRun, rs)
+	}
+
+	if rs.retention != nil {
+		s.applyRetention(rs.retention, rs)
+	}
+
+	// We don't apply processDir() directly to the root because we don't want to delete it if it's empty
+	dirContents, readDirErr := ioutil.ReadDir(rootDir)
+	if readDirErr != nil {
+		logging.Log.Errorf("Unable to read root directory <%s>: %v", rootDir, readDirErr)
+		rs.addError(rootDir, readDirErr)
+		return
+	}
+
+	for _, rule := range rs.rules {
+		rule.startSweep()
+	}
+
+	logging.Log.Debugf("Directory <%s> is not empty; processing contents", rootDir)
+	for _, fileInfo := range dirContents {
+		if rs.aborted || s.stopRequested() {
+			break
+		}
+		if fileInfo.IsDir() {
+			s.processDir(fileInfo, rootDir, rs)
+		} else {
+			s.processFile(fileInfo, rootDir, rs)
+		}
+	}
+	for _, rule := range rs.rules {
+		rule.logSweep()
+	}
+	logging.Log.Debugf("Finished processing <%s>", rootDir)
+}
+
+// sweepRoots sweeps each of the rootDirs independently and logs a summary.
+// A root that takes longer than rootTimeout is reported as stalled and left to finish on its own;
+// it's skipped by later sweeps until it does.
+func (s *sweeper) sweepRoots(rootDirs []string) (summary *sweepSummary) {
+	start := time.Now()
+	summary = &sweepSummary{}
+	done := make(chan *rootSweep, len(rootDirs))
+	nRunning := 0
+	for _, rootDir := range rootDirs {
+		if !s.busy.claim(rootDir) {
+			logging.Log.Warningf("The previous sweep of <%s> is still running; skipping it", rootDir)
+			summary.roots = append(summary.roots, &rootSweep{root: rootDir, start: time.Now(), stalled: true})
+			continue
 		}
+		rs := s.newRootSweep(rootDir)
+		summary.roots = append(summary.roots, rs)
+		nRunning++
+		go func() {
+			defer s.busy.release(rs.root)
+			s.sweepRoot(rs)
+			rs.duration = time.Since(rs.start)
+			done <- rs
+		}()
+	}
 
+	finished := make(map[*rootSweep]bool)
+	var timeout <-chan time.Time
+	s.lock.RLock()
+	if s.rootTimeout > 0 {
+		timeout = time.After(s.rootTimeout)
+	}
+	s.lock.RUnlock()
+waitLoop:
+	for len(finished) < nRunning {
+		select {
+		case rs := <-done:
+			finished[rs] = true
+		case <-timeout:
+			break waitLoop
+		}
+	}
+	for iRoot, rs := range summary.roots {
+		if !rs.stalled && !finished[rs] {
+			// the goroutine still owns rs, so the summary gets a placeholder
+			summary.roots[iRoot] = &rootSweep{root: rs.root, start: rs.start, stalled: true}
+		}
 	}
 
-	logging.Log.Debugf("No action taken on directory <%s>", dirName)
-	return nil
+	summary.duration = time.Since(start)
+	summary.interrupted = s.stopRequested()
+	summary.log()
+	s.notifier.publishSweep(summary)
+	return
 }
 
 func main() {
@@ -75,6 +362,14 @@ func main() {
 	// configuration file
 	var configFile string
 
+	// sweep once and exit
+	var once bool
+
+	// dry-run options
+	var dryRun bool
+	var reportFormat string
+	var reportFile string
+
 	// set up flag to point at conf, parse arguments and then verify
 	flag.BoolVar(&needHelp,
 		"help",
@@ -84,6 +379,22 @@ func main() {
 		"config",
 		"",
 		"JSON configuration file")
+	flag.BoolVar(&once,
+		"once",
+		false,
+		"Sweep the root directories once and exit, e.g. when run from cron or a systemd timer")
+	flag.BoolVar(&dryRun,
+		"dry-run",
+		false,
+		"Sweep the root directories once without removing anything, and report what would be removed")
+	flag.StringVar(&reportFormat,
+		"report-format",
+		"text",
+		"Format of the dry-run report: text or json")
+	flag.StringVar(&reportFile,
+		"report",
+		"",
+		"File to which the dry-run report is written (default: standard output)")
 	flag.Parse()
 
 	if needHelp {
@@ -136,114 +447,243 @@ func main() {
 	viper.SetDefault("log-level", "INFO")
 	viper.SetDefault("maximum-age", "1h")
 	viper.SetDefault("wait-interval", "10m")
+	viper.SetDefault("watch-mode", "poll")
+	viper.SetDefault("watch-check-interval", "1m")
+	viper.SetDefault("keep-marker", ".dungbeetle-keep")
+	viper.SetDefault("max-errors", 100)
+	viper.SetDefault("root-timeout", "30m")
+	viper.SetDefault("root-check-timeout", "30s")
+	viper.SetDefault("alerts", false)
+	viper.SetDefault("broker", "localhost")
+	viper.SetDefault("subscribe-queue", "dungbeetle-queue")
+	viper.SetDefault("sweep-alert-key", "status_message.notice.dungbeetle")
+	viper.SetDefault("removal-alert-key", "")
 
 	// load config
 	if configFile != "" {
 		viper.SetConfigFile(configFile)
 		if parseErr := viper.ReadInConfig(); parseErr != nil {
 			logging.Log.Criticalf("%v", parseErr)
-			os.Exit(1)
+			os.Exit(exitFatal)
 		}
 		logging.Log.Notice("Config file loaded")
 	}
 	logging.ConfigureLogging(viper.GetString("log-level"))
 	logging.Log.Infof("Log level: %v", viper.GetString("log-level"))
 
-	maxAge := viper.GetDuration("maximum-age")
 	waitInterval := viper.GetDuration("wait-interval")
+	watchMode := viper.GetString("watch-mode")
+	watchCheckInterval := viper.GetDuration("watch-check-interval")
 
-	rootDirs := viper.GetStringSlice("root-dirs")
-	if len(rootDirs) == 0 {
+	configuredRootDirs := viper.GetStringSlice("root-dirs")
+	if len(configuredRootDirs) == 0 {
 		logging.Log.Critical("No root directories were provided")
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
 
-	// Clean up and check the root directories
-	for rdInd, rootDir := range rootDirs {
-		rootDirAbs, rdErr := filepath.Abs(filepath.Clean(rootDir))
-		if rdErr != nil {
-			logging.Log.Criticalf("Unable to get absolute form of the root directory <%s>", rootDir)
-			os.Exit(1)
-		}
+	// Clean up and check the root directories; the ones that can't be used are skipped, and the rest are swept.
+	// The settings are still checked against all of them.
+	allRootDirs, rootDirs, rootsErr := checkRootDirs(configuredRootDirs, viper.GetDuration("root-check-timeout"))
+	if rootsErr != nil {
+		logging.Log.Critical(rootsErr.Error())
+		os.Exit(exitFatal)
+	}
+	if len(rootDirs) == 0 {
+		logging.Log.Critical("None of the root directories can be used")
+		os.Exit(exitFatal)
+	}
+	nBadRoots := len(allRootDirs) - len(rootDirs)
 
-		// Do a couple checks on the root directory
-		rootDirInfo, statErr := os.Stat(rootDirAbs)
-		if statErr != nil {
-			logging.Log.Criticalf("Unable to \"Stat\" the root directory <%s>", rootDirAbs)
-			os.Exit(1)
-		}
-		if !rootDirInfo.IsDir() {
-			logging.Log.Criticalf("Root directory <%s> is not a directory", rootDirAbs)
-			os.Exit(1)
-		}
+	theSweeper := &sweeper{
+		stop: make(chan struct{}),
+	}
+	if settingsErr := theSweeper.loadSettings(allRootDirs); settingsErr != nil {
+		logging.Log.Critical(settingsErr.Error())
+		os.Exit(exitFatal)
+	}
 
-		rootDirs[rdInd] = rootDirAbs
-		logging.Log.Noticef("Monitoring <%s>", rootDirAbs)
+	// Reloads are asked for by SIGHUP and by changes to the config file, and are done one at a time by a single goroutine
+	// (started once everything else has been read from the configuration), since viper can't be used concurrently.
+	// Requests that arrive while a reload is waiting are folded into it.
+	reloadRequests := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reloadRequests <- struct{}{}:
+		default:
+		}
 	}
 
-	ignoreDirsInput := viper.GetStringSlice("ignore")
-	var ignoreDirs map[string]bool
-	ignoreDirs = make(map[string]bool)
-	// Clean up and check the ignore directories
-	for _, ignoreDir := range ignoreDirsInput {
-		ignoreDirAbs, idErr := filepath.Abs(filepath.Clean(ignoreDir))
-		if idErr != nil {
-			logging.Log.Criticalf("Unable to get absolute form of the root directory <%s>", ignoreDir)
-			os.Exit(1)
+	// SIGINT and SIGTERM stop dungbeetle once it has finished the directory it's in; a second one stops it immediately.
+	// SIGHUP reloads the config file.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGHUP:
+				requestReload()
+			default:
+				if theSweeper.stopRequested() {
+					logging.Log.Criticalf("Received %v again; exiting immediately", sig)
+					os.Exit(exitFatal)
+				}
+				logging.Log.Noticef("Received %v; stopping once the current directory is finished", sig)
+				theSweeper.requestStop()
+			}
 		}
+	}()
 
-		// Do a couple checks on the ignore directory
-		ignoreDirInfo, statErr := os.Stat(ignoreDirAbs)
-		if statErr != nil {
-			logging.Log.Criticalf("Unable to \"Stat\" the ignore-directory <%s>", ignoreDirAbs)
-			os.Exit(1)
+	if dryRun {
+		if reportFormat != "text" && reportFormat != "json" {
+			logging.Log.Criticalf("Unknown report format <%s>; options are \"text\" and \"json\"", reportFormat)
+			os.Exit(exitFatal)
 		}
-		if !ignoreDirInfo.IsDir() {
-			logging.Log.Criticalf("Ignore directory <%s> is not a directory", ignoreDirAbs)
-			os.Exit(1)
+		logging.Log.Notice("Dry run: nothing will be removed")
+		theSweeper.dryRun = true
+		theSweeper.report = &sweepReport{}
+		summary := theSweeper.sweepRoots(rootDirs)
+		if reportErr := theSweeper.report.write(reportFile, reportFormat); reportErr != nil {
+			logging.Log.Criticalf("Unable to write the report: %v", reportErr)
+			os.Exit(exitFatal)
 		}
+		if nBadRoots > 0 {
+			os.Exit(exitErrors)
+		}
+		os.Exit(summary.exitStatus())
+	}
 
-		ignoreDirs[ignoreDirAbs] = true
-		logging.Log.Noticef("Ignoring <%s>", ignoreDirAbs)
+	if viper.GetBool("alerts") {
+		notifier, notifierErr := startActivityNotifier()
+		if notifierErr != nil {
+			logging.Log.Criticalf("Unable to start sending alerts: %v", notifierErr)
+			os.Exit(exitFatal)
+		}
+		theSweeper.notifier = notifier
 	}
 
-	logging.Log.Notice("Watching for stale directories.  Use ctrl-c to exit")
+	go func() {
+		for range reloadRequests {
+			reloadConfig(configFile, allRootDirs, theSweeper)
+		}
+	}()
 
-	//mainLoop:
-	for {
-		// Loop over the contents of rootDirs
-		// We don't apply processDir() directly to the rootDirs because we don't want to delete rootDir if it's empty
-		for _, rootDir := range rootDirs {
-			logging.Log.Debugf("Processing directory <%s>", rootDir)
+	// the config file is reloaded whenever it changes, just as with SIGHUP
+	if configFile != "" {
+		if watchErr := watchConfigFile(configFile, requestReload); watchErr != nil {
+			logging.Log.Errorf("Unable to watch the config file; it will only be reloaded on SIGHUP: %v", watchErr)
+		}
+	}
 
-			dirContents, readDirErr := ioutil.ReadDir(rootDir)
-			if readDirErr != nil {
-				logging.Log.Criticalf("Unable to read directory <%s>", rootDir)
-				os.Exit(1)
+	exitStatus := exitClean
+	if once {
+		exitStatus = theSweeper.sweepRoots(rootDirs).exitStatus()
+	} else {
+		logging.Log.Notice("Watching for stale directories.  Use ctrl-c to exit")
+
+		switch watchMode {
+		case "poll":
+		mainLoop:
+			for {
+				exitStatus = theSweeper.sweepRoots(rootDirs).exitStatus()
+
+				// Wait the specified amount of time before running again
+				select {
+				case <-time.After(waitInterval):
+				case <-theSweeper.stop:
+					break mainLoop
+				}
 			}
-
-			exitOnErrors := false
-
-			for _, fileInfo := range dirContents {
-				logging.Log.Debugf("Directory <%s> is not empty; processing contents", rootDir)
-				if fileInfo.IsDir() {
-					if procErr := processDir(fileInfo, rootDir, maxAge, ignoreDirs); procErr != nil {
-						logging.Log.Errorf("An error occurred while processing directory <%s>: %v", fileInfo.Name(), procErr)
-						exitOnErrors = true
-					}
-				} // else it's a file; ignore it
+		case "inotify":
+			watcher, watchErr := newEmptyDirWatcher(rootDirs, theSweeper)
+			if watchErr != nil {
+				logging.Log.Criticalf("Unable to start watching the root directories: %v", watchErr)
+				os.Exit(exitFatal)
 			}
-			logging.Log.Debugf("Finished processing <%s>", rootDir)
-
-			if exitOnErrors == true {
-				logging.Log.Critical("Exiting due to directory-processing errors")
-				break
+			summary, runErr := watcher.run(watchCheckInterval, waitInterval)
+			if runErr != nil {
+				logging.Log.Criticalf("Stopped watching the root directories: %v", runErr)
+				exitStatus = exitFatal
+			} else if summary != nil {
+				exitStatus = summary.exitStatus()
 			}
+		default:
+			logging.Log.Criticalf("Unknown watch mode <%s>; options are \"poll\" and \"inotify\"", watchMode)
+			os.Exit(exitFatal)
 		}
-
-		// Wait the specified amount of time before running again
-		time.Sleep(waitInterval)
 	}
 
+	if nBadRoots > 0 && exitStatus == exitClean {
+		exitStatus = exitErrors
+	}
 	logging.Log.Notice("DungBeetle says: \"My job here is done\"")
+	os.Exit(exitStatus)
+}
+
+// reloadConfig re-reads the config file and replaces the settings; the root directories can't be changed without a restart
+func reloadConfig(configFile string, rootDirs []string, theSweeper *sweeper) {
+	if configFile == "" {
+		logging.Log.Notice("No config file to reload")
+		return
+	}
+	logging.Log.Notice("Reloading the config file")
+	if parseErr := viper.ReadInConfig(); parseErr != nil {
+		logging.Log.Errorf("Unable to reload the config file; keeping the previous settings: %v", parseErr)
+		return
+	}
+	logging.ConfigureLogging(viper.GetString("log-level"))
+	if settingsErr := theSweeper.loadSettings(rootDirs); settingsErr != nil {
+		logging.Log.Errorf("%v; keeping the previous settings", settingsErr)
+		return
+	}
+	isRoot := make(map[string]bool)
+	for _, rootDir := range rootDirs {
+		isRoot[rootDir] = true
+	}
+	newRootDirs := viper.GetStringSlice("root-dirs")
+	for _, rootDir := range newRootDirs {
+		if rootDirAbs, rdErr := filepath.Abs(filepath.Clean(rootDir)); rdErr != nil || !isRoot[rootDirAbs] || len(newRootDirs) != len(rootDirs) {
+			logging.Log.Warning("The root directories can't be changed by reloading; restart to apply the change")
+			break
+		}
+	}
+	logging.Log.Notice("Config file reloaded")
+}
+
+// watchConfigFile calls reload whenever the config file is written or replaced.
+// The directory is watched rather than the file itself, since editors often replace the file rather than writing to it.
+func watchConfigFile(configFile string, reload func()) (e error) {
+	configAbs, absErr := filepath.Abs(filepath.Clean(configFile))
+	if absErr != nil {
+		e = absErr
+		return
+	}
+	fsWatcher, watcherErr := fsnotify.NewWatcher()
+	if watcherErr != nil {
+		e = watcherErr
+		return
+	}
+	if e = fsWatcher.Add(filepath.Dir(configAbs)); e != nil {
+		fsWatcher.Close()
+		return
+	}
+	go func() {
+		for {
+			select {
+			case event, chanOpen := <-fsWatcher.Events:
+				if !chanOpen {
+					return
+				}
+				if event.Name == configAbs && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					logging.Log.Notice("Config file changed")
+					reload()
+				}
+			case watchErr, chanOpen := <-fsWatcher.Errors:
+				if !chanOpen {
+					return
+				}
+				logging.Log.Errorf("Error watching the config file: %v", watchErr)
+			}
+		}
+	}()
+	return
 }
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// Actions that a file rule can take
+const (
+	actionDelete   = "delete"
+	actionMove     = "move"
+	actionCompress = "compress"
+)
+
+// fileRuleConfig is the configuration form of a file rule
+type fileRuleConfig struct {
+	Name       string        `mapstructure:"name"`
+	Root       string        `mapstructure:"root"`
+	Glob       string        `mapstructure:"glob"`
+	Regex      string        `mapstructure:"regex"`
+	MinimumAge time.Duration `mapstructure:"minimum-age"`
+	FreeBelow  float64       `mapstructure:"free-fraction-below"`
+	Action     string        `mapstructure:"action"`
+	TrashDir   string        `mapstructure:"trash-dir"`
+}
+
+// fileRule expires files matching a pattern in one root directory
+type fileRule struct {
+	name       string
+	root       string
+	glob       string
+	regex      *regexp.Regexp
+	minimumAge time.Duration
+	// the rule is only applied when the fraction of free space on the root's filesystem is below freeBelow; 0 disables the trigger
+	freeBelow float64
+	action    string
+	trashDir  string
+
+	// active is evaluated at the start of each sweep
+	active bool
+	// counts for the current sweep
+	nMatched int
+	nActed   int
+	nErrors  int
+	nBytes   int64
+}
+
+// loadFileRules reads the "file-rules" configuration and groups the rules by root directory
+func loadFileRules(rootDirs []string) (rulesByRoot map[string][]*fileRule, e error) {
+	rulesByRoot = make(map[string][]*fileRule)
+	isRoot := make(map[string]bool)
+	for _, rootDir := range rootDirs {
+		isRoot[rootDir] = true
+	}
+
+	var ruleConfigs []fileRuleConfig
+	if e = viper.UnmarshalKey("file-rules", &ruleConfigs); e != nil {
+		return
+	}
+	for iRule, config := range ruleConfigs {
+		rule := &fileRule{
+			name:       config.Name,
+			glob:       config.Glob,
+			minimumAge: config.MinimumAge,
+			freeBelow:  config.FreeBelow,
+			action:     config.Action,
+		}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule-%d", iRule)
+		}
+
+		var absErr error
+		if rule.root, absErr = filepath.Abs(filepath.Clean(config.Root)); absErr != nil || !isRoot[rule.root] {
+			e = fmt.Errorf("File rule <%s> must have a root that is one of the root directories", rule.name)
+			return
+		}
+
+		if (config.Glob == "") == (config.Regex == "") {
+			e = fmt.Errorf("File rule <%s> must have either a glob or a regex", rule.name)
+			return
+		}
+		if config.Glob != "" {
+			if _, matchErr := filepath.Match(config.Glob, ""); matchErr != nil {
+				e = fmt.Errorf("File rule <%s> has an invalid glob: %v", rule.name, matchErr)
+				return
+			}
+		} else {
+			var reErr error
+			if rule.regex, reErr = regexp.Compile(config.Regex); reErr != nil {
+				e = fmt.Errorf("File rule <%s> has an invalid regex: %v", rule.name, reErr)
+				return
+			}
+		}
+
+		switch rule.action {
+		case actionDelete, actionCompress:
+		case actionMove:
+			if config.TrashDir == "" {
+				e = fmt.Errorf("File rule <%s> moves files but has no trash-dir", rule.name)
+				return
+			}
+			if rule.trashDir, absErr = filepath.Abs(filepath.Clean(config.TrashDir)); absErr != nil {
+				e = fmt.Errorf("Unable to get absolute form of the trash directory <%s>", config.TrashDir)
+				return
+			}
+			// a trash directory inside a root directory would itself be swept
+			for _, rootDir := range rootDirs {
+				if rule.trashDir == rootDir || strings.HasPrefix(rule.trashDir, rootDir+string(os.PathSeparator)) {
+					e = fmt.Errorf("File rule <%s> has trash directory <%s> inside root directory <%s>", rule.name, rule.trashDir, rootDir)
+					return
+				}
+			}
+		default:
+			e = fmt.Errorf("File rule <%s> has unknown action <%s>; options are \"delete\", \"move\" and \"compress\"", rule.name, rule.action)
+			return
+		}
+
+		rulesByRoot[rule.root] = append(rulesByRoot[rule.root], rule)
+		logging.Log.Noticef("File rule <%s> will %s files in <%s> older than %v", rule.name, rule.action, rule.root, rule.minimumAge)
+	}
+	return
+}
+
+// freeFraction returns the fraction of space on path's filesystem that is available to unprivileged users
+func freeFraction(path string) (fraction float64, e error) {
+	used, avail, statErr := filesystemUsage(path)
+	if statErr != nil {
+		e = statErr
+		return
+	}
+	fraction = 1 - usedFraction(used, avail)
+	return
+}
+
+// startSweep resets the counts and evaluates the free-space trigger
+func (rule *fileRule) startSweep() {
+	rule.nMatched, rule.nActed, rule.nErrors, rule.nBytes = 0, 0, 0, 0
+	rule.active = true
+	if rule.freeBelow > 0 {
+		fraction, statErr := freeFraction(rule.root)
+		if statErr != nil {
+			logging.Log.Errorf("Unable to get the free space for <%s>; file rule <%s> will not be applied: %v", rule.root, rule.name, statErr)
+			rule.active = false
+			return
+		}
+		rule.active = fraction < rule.freeBelow
+		logging.Log.Debugf("File rule <%s>: free fraction %.3f, trigger %.3f, active: %v", rule.name, fraction, rule.freeBelow, rule.active)
+	}
+}
+
+// logSweep reports the counts for the sweep that just finished
+func (rule *fileRule) logSweep() {
+	if !rule.active {
+		return
+	}
+	logging.Log.Infof("File rule <%s>: %d files matched, %d acted on (%d bytes), %d errors", rule.name, rule.nMatched, rule.nActed, rule.nBytes, rule.nErrors)
+}
+
+func (rule *fileRule) matches(fileInfo os.FileInfo) bool {
+	if rule.regex != nil {
+		return rule.regex.MatchString(fileInfo.Name())
+	}
+	matched, _ := filepath.Match(rule.glob, fileInfo.Name())
+	return matched
+}
+
+// processFile applies the first matching rule for the root to a file.
+// The return value says whether the file is no longer in dirName (or, in a dry run, would no longer be).
+func (s *sweeper) processFile(fileInfo os.FileInfo, dirName string, rs *rootSweep) (removed bool) {
+	if !fileInfo.Mode().IsRegular() {
+		return
+	}
+	fileName := filepath.Join(dirName, fileInfo.Name())
+	for _, rule := range rs.rules {
+		if !rule.active || !rule.matches(fileInfo) {
+			continue
+		}
+		if time.Since(fileInfo.ModTime()) <= rule.minimumAge {
+			logging.Log.Debugf("File rule <%s>: <%s> is too young", rule.name, fileName)
+			return
+		}
+		if rule.action == actionCompress && strings.HasSuffix(fileInfo.Name(), ".gz") {
+			return
+		}
+		rule.nMatched++
+
+		if s.dryRun {
+			logging.Log.Infof("File rule <%s>: would %s <%s>", rule.name, rule.action, fileName)
+			s.report.addFile(fileName, fileInfo.ModTime(), rule.name, rule.action)
+			if rule.action != actionCompress {
+				rs.nRemoved++
+			}
+			return rule.action != actionCompress
+		}
+
+		var actErr error
+		switch rule.action {
+		case actionDelete:
+			actErr = s.removeTree(fileName, fileInfo, rs)
+		case actionMove:
+			actErr = moveToTrash(fileName, rule.root, rule.trashDir)
+		case actionCompress:
+			actErr = compressFile(fileName, fileInfo)
+		}
+		if actErr != nil {
+			logging.Log.Errorf("File rule <%s>: unable to %s <%s>: %v", rule.name, rule.action, fileName, actErr)
+			rule.nErrors++
+			rs.addError(fileName, actErr)
+			return
+		}
+		logging.Log.Infof("File rule <%s>: %s <%s>", rule.name, pastTense(rule.action), fileName)
+		s.report.addFile(fileName, fileInfo.ModTime(), rule.name, rule.action)
+		rule.nActed++
+		rule.nBytes += fileInfo.Size()
+		action, reclaimed := rule.action, fileInfo.Size()
+		switch {
+		case rule.action == actionDelete && rs.archive != nil:
+			action = retentionArchive
+		case rule.action == actionCompress:
+			if gzInfo, statErr := os.Stat(fileName + ".gz"); statErr == nil {
+				reclaimed -= gzInfo.Size()
+			}
+		}
+		s.recordRemoval(rs, fileName, removalFileRule, action, reclaimed, fileInfo.ModTime())
+		if rule.action != actionCompress {
+			rs.nRemoved++
+		}
+		return rule.action != actionCompress
+	}
+	return
+}
+
+func pastTense(action string) string {
+	switch action {
+	case actionDelete:
+		return "deleted"
+	case actionMove:
+		return "moved"
+	case actionCompress:
+		return "compressed"
+	case retentionArchive:
+		return "archived"
+	}
+	return action
+}
+
+// moveToTrash moves fileName to the same relative location under trashDir that it has under root
+func moveToTrash(fileName string, root string, trashDir string) (e error) {
+	relPath, relErr := filepath.Rel(root, fileName)
+	if relErr != nil {
+		e = relErr
+		return
+	}
+	trashName := filepath.Join(trashDir, relPath)
+	if e = os.MkdirAll(filepath.Dir(trashName), os.ModeDir|0775); e != nil {
+		return
+	}
+	if renameErr := os.Rename(fileName, trashName); renameErr == nil {
+		return
+	}
+	// the trash may be on a different filesystem, in which case the file has to be copied
+	if e = copyFile(fileName, trashName); e != nil {
+		os.Remove(trashName)
+		return
+	}
+	e = os.Remove(fileName)
+	return
+}
+
+func copyFile(srcName string, dstName string) (e error) {
+	src, openErr := os.Open(srcName)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	defer src.Close()
+
+	dst, createErr := os.Create(dstName)
+	if createErr != nil {
+		e = createErr
+		return
+	}
+	if _, e = io.Copy(dst, src); e != nil {
+		dst.Close()
+		return
+	}
+	e = dst.Close()
+	return
+}
+
+// compressFile replaces fileName with fileName.gz, preserving the modification time
+func compressFile(fileName string, fileInfo os.FileInfo) (e error) {
+	gzName := fileName + ".gz"
+	src, openErr := os.Open(fileName)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	defer src.Close()
+
+	dst, createErr := os.OpenFile(gzName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileInfo.Mode().Perm())
+	if createErr != nil {
+		e = createErr
+		return
+	}
+	gzWriter := gzip.NewWriter(dst)
+	gzWriter.Name = fileInfo.Name()
+	gzWriter.ModTime = fileInfo.ModTime()
+	if _, e = io.Copy(gzWriter, src); e == nil {
+		e = gzWriter.Close()
+	}
+	if closeErr := dst.Close(); e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		os.Remove(gzName)
+		return
+	}
+	if e = os.Chtimes(gzName, fileInfo.ModTime(), fileInfo.ModTime()); e != nil {
+		return
+	}
+	e = os.Remove(fileName)
+	return
+}
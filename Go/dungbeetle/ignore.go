@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/spf13/viper"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// ignoreRules decides which directories dungbeetle leaves alone.
+// An ignored directory is neither removed nor descended into.
+//
+// Each entry in the "ignore" configuration is either:
+//   - an absolute path, which ignores exactly that directory (it does not have to exist yet);
+//   - a gitignore-style pattern: anything containing *, ? or [, or any relative path.  Absolute patterns are matched
+//     against the absolute path; relative patterns are matched against the path relative to each root directory,
+//     and patterns without a "/" match a directory name at any depth.  "**" matches any number of directories.
+//
+// In addition, a directory containing the marker file protects its whole subtree.
+type ignoreRules struct {
+	exact      map[string]bool
+	patterns   []string
+	markerFile string
+}
+
+// loadIgnoreRules reads the "ignore" and "keep-marker" configuration
+func loadIgnoreRules() (rules *ignoreRules, e error) {
+	rules = &ignoreRules{
+		exact:      make(map[string]bool),
+		markerFile: viper.GetString("keep-marker"),
+	}
+	for _, entry := range viper.GetStringSlice("ignore") {
+		if strings.ContainsAny(entry, "*?[") || !filepath.IsAbs(entry) {
+			pattern := strings.TrimSuffix(entry, "/")
+			if !strings.HasPrefix(pattern, "/") && !strings.Contains(pattern, "/") {
+				pattern = "**/" + pattern
+			}
+			if _, matchErr := doublestar.Match(pattern, ""); matchErr != nil {
+				logging.Log.Errorf("Invalid ignore pattern <%s>: %v", entry, matchErr)
+				e = matchErr
+				return
+			}
+			rules.patterns = append(rules.patterns, pattern)
+			logging.Log.Noticef("Ignoring directories matching <%s>", pattern)
+			continue
+		}
+
+		ignoreDirAbs, idErr := filepath.Abs(filepath.Clean(entry))
+		if idErr != nil {
+			logging.Log.Errorf("Unable to get absolute form of the ignore directory <%s>", entry)
+			e = idErr
+			return
+		}
+		// It's fine for an ignored directory not to exist (yet), but it's worth a mention
+		if ignoreDirInfo, statErr := os.Stat(ignoreDirAbs); statErr != nil {
+			logging.Log.Noticef("Ignore directory <%s> does not currently exist", ignoreDirAbs)
+		} else if !ignoreDirInfo.IsDir() {
+			logging.Log.Warningf("Ignore directory <%s> is not a directory", ignoreDirAbs)
+		}
+
+		rules.exact[ignoreDirAbs] = true
+		logging.Log.Noticef("Ignoring <%s>", ignoreDirAbs)
+	}
+	if rules.markerFile != "" {
+		logging.Log.Noticef("Directories containing <%s> will be kept along with everything below them", rules.markerFile)
+	}
+	return
+}
+
+// matches checks a directory (an absolute, clean path under root) against the ignore list
+func (rules *ignoreRules) matches(root string, dirName string) bool {
+	if rules.exact[dirName] {
+		return true
+	}
+	relPath, relErr := filepath.Rel(root, dirName)
+	if relErr != nil {
+		relPath = dirName
+	}
+	for _, pattern := range rules.patterns {
+		target := relPath
+		if strings.HasPrefix(pattern, "/") {
+			target = dirName
+		}
+		if matched, _ := doublestar.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMarker checks a directory's contents for the marker file
+func (rules *ignoreRules) hasMarker(dirContents []os.FileInfo) bool {
+	for _, fileInfo := range dirContents {
+		if rules.isMarker(fileInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMarker checks whether a file is the marker file
+func (rules *ignoreRules) isMarker(fileInfo os.FileInfo) bool {
+	return rules.markerFile != "" && fileInfo.Name() == rules.markerFile && !fileInfo.IsDir()
+}
+
+// currentIgnoreRules returns the ignore rules in effect; they're replaced as a whole when the configuration is reloaded
+func (s *sweeper) currentIgnoreRules() *ignoreRules {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ignore
+}
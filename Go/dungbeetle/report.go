@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons for which a directory is skipped
+const (
+	skipIgnored    = "ignored"
+	skipTooYoung   = "too young"
+	skipNotEmpty   = "not empty"
+	skipKeepMarker = "keep marker"
+)
+
+type reportEntry struct {
+	Path       string  `json:"path"`
+	Age        string  `json:"age"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Reason     string  `json:"reason,omitempty"`
+	Rule       string  `json:"rule,omitempty"`
+	Action     string  `json:"action,omitempty"`
+}
+
+// sweepReport lists the directories that were (or would have been) removed and those that were skipped,
+// and the files that file rules acted (or would have acted) on.
+// The methods are safe to call on a nil report, in which case nothing is recorded,
+// and from the goroutines sweeping different roots.
+type sweepReport struct {
+	lock sync.Mutex
+
+	Removed   []reportEntry `json:"removed"`
+	Skipped   []reportEntry `json:"skipped"`
+	Files     []reportEntry `json:"files"`
+	Retention []reportEntry `json:"retention"`
+}
+
+func newReportEntry(dirName string, modTime time.Time, reason string) reportEntry {
+	age := time.Since(modTime)
+	return reportEntry{
+		Path:       dirName,
+		Age:        age.Truncate(time.Second).String(),
+		AgeSeconds: age.Seconds(),
+		Reason:     reason,
+	}
+}
+
+func (r *sweepReport) addRemoved(dirName string, modTime time.Time) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Removed = append(r.Removed, newReportEntry(dirName, modTime, ""))
+}
+
+func (r *sweepReport) addSkipped(dirName string, modTime time.Time, reason string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Skipped = append(r.Skipped, newReportEntry(dirName, modTime, reason))
+}
+
+func (r *sweepReport) addFile(fileName string, modTime time.Time, rule string, action string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := newReportEntry(fileName, modTime, "")
+	entry.Rule = rule
+	entry.Action = action
+	r.Files = append(r.Files, entry)
+}
+
+func (r *sweepReport) addRetention(dirName string, modTime time.Time, action string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := newReportEntry(dirName, modTime, "disk pressure")
+	entry.Action = action
+	r.Retention = append(r.Retention, entry)
+}
+
+// write outputs the report as "text" or "json" to fileName, or to standard output if fileName is empty
+func (r *sweepReport) write(fileName string, format string) (e error) {
+	var out io.Writer = os.Stdout
+	if fileName != "" {
+		outFile, createErr := os.Create(fileName)
+		if createErr != nil {
+			e = createErr
+			return
+		}
+		defer func() {
+			if closeErr := outFile.Close(); e == nil {
+				e = closeErr
+			}
+		}()
+		out = outFile
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch format {
+	case "json":
+		encoded, jsonErr := json.MarshalIndent(r, "", "    ")
+		if jsonErr != nil {
+			e = jsonErr
+			return
+		}
+		_, e = fmt.Fprintln(out, string(encoded))
+	case "text":
+		fmt.Fprintf(out, "Directories to remove (%d):\n", len(r.Removed))
+		for _, entry := range r.Removed {
+			fmt.Fprintf(out, "    %s (age %s)\n", entry.Path, entry.Age)
+		}
+		fmt.Fprintf(out, "Directories skipped (%d):\n", len(r.Skipped))
+		for _, entry := range r.Skipped {
+			fmt.Fprintf(out, "    %s (age %s): %s\n", entry.Path, entry.Age, entry.Reason)
+		}
+		fmt.Fprintf(out, "Files acted on by rules (%d):\n", len(r.Files))
+		for _, entry := range r.Files {
+			fmt.Fprintf(out, "    %s (age %s): %s by rule <%s>\n", entry.Path, entry.Age, entry.Action, entry.Rule)
+		}
+		fmt.Fprintf(out, "Directories removed for retention (%d):\n", len(r.Retention))
+		for _, entry := range r.Retention {
+			_, e = fmt.Fprintf(out, "    %s (age %s): %s\n", entry.Path, entry.Age, entry.Action)
+		}
+	default:
+		e = fmt.Errorf("Unknown report format <%s>; options are \"text\" and \"json\"", format)
+	}
+	return
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// keepMarker protects the directory containing it, and every directory above it, from retention
+const keepMarker = ".keep"
+
+// errProtected stops the walk through a run directory once a keep marker is found
+var errProtected = errors.New("directory is protected")
+
+// Actions that retention can take
+const (
+	retentionDelete  = "delete"
+	retentionArchive = "archive"
+)
+
+// retentionConfig is the configuration form of a retention policy
+type retentionConfig struct {
+	Root        string  `mapstructure:"root"`
+	HighWater   float64 `mapstructure:"high-water"`
+	LowWater    float64 `mapstructure:"low-water"`
+	Depth       int     `mapstructure:"depth"`
+	Order       string  `mapstructure:"order"`
+	NamePattern string  `mapstructure:"name-pattern"`
+	Action      string  `mapstructure:"action"`
+	ArchiveDir  string  `mapstructure:"archive-dir"`
+}
+
+// retentionPolicy removes the oldest run directories in a root when its filesystem's usage crosses highWater,
+// until the usage drops below lowWater
+type retentionPolicy struct {
+	root      string
+	highWater float64
+	lowWater  float64
+	// run directories are this many levels below the root
+	depth int
+	// "mtime" or "name"
+	order string
+	// if set, only directories whose names match are eligible; with the "name" order, the first submatch (or the whole match) is the sort key
+	namePattern *regexp.Regexp
+	action      string
+	archiveDir  string
+}
+
+// runDir is a candidate for removal
+type runDir struct {
+	path    string
+	modTime time.Time
+	sortKey string
+}
+
+// loadRetentionPolicies reads the "retention" configuration, keyed by root directory
+func loadRetentionPolicies(rootDirs []string) (policies map[string]*retentionPolicy, e error) {
+	policies = make(map[string]*retentionPolicy)
+	isRoot := make(map[string]bool)
+	for _, rootDir := range rootDirs {
+		isRoot[rootDir] = true
+	}
+
+	var configs []retentionConfig
+	if e = viper.UnmarshalKey("retention", &configs); e != nil {
+		return
+	}
+	for _, config := range configs {
+		policy := &retentionPolicy{
+			highWater: config.HighWater,
+			lowWater:  config.LowWater,
+			depth:     config.Depth,
+			order:     config.Order,
+			action:    config.Action,
+		}
+
+		var absErr error
+		if policy.root, absErr = filepath.Abs(filepath.Clean(config.Root)); absErr != nil || !isRoot[policy.root] {
+			e = fmt.Errorf("Retention policy for <%s> must have a root that is one of the root directories", config.Root)
+			return
+		}
+		if _, isDuplicate := policies[policy.root]; isDuplicate {
+			e = fmt.Errorf("There is more than one retention policy for <%s>", policy.root)
+			return
+		}
+		if policy.highWater <= 0 || policy.highWater > 1 || policy.lowWater <= 0 || policy.lowWater >= policy.highWater {
+			e = fmt.Errorf("Retention policy for <%s> must have 0 < low-water < high-water <= 1", policy.root)
+			return
+		}
+		if policy.depth == 0 {
+			policy.depth = 1
+		}
+		if policy.order == "" {
+			policy.order = "mtime"
+		}
+		if policy.order != "mtime" && policy.order != "name" {
+			e = fmt.Errorf("Retention policy for <%s> has unknown order <%s>; options are \"mtime\" and \"name\"", policy.root, policy.order)
+			return
+		}
+		if config.NamePattern != "" {
+			var reErr error
+			if policy.namePattern, reErr = regexp.Compile(config.NamePattern); reErr != nil {
+				e = fmt.Errorf("Retention policy for <%s> has an invalid name-pattern: %v", policy.root, reErr)
+				return
+			}
+		}
+		if policy.action == "" {
+			policy.action = retentionDelete
+		}
+		switch policy.action {
+		case retentionDelete:
+		case retentionArchive:
+			if config.ArchiveDir == "" {
+				e = fmt.Errorf("Retention policy for <%s> archives directories but has no archive-dir", policy.root)
+				return
+			}
+			if policy.archiveDir, absErr = filepath.Abs(filepath.Clean(config.ArchiveDir)); absErr != nil {
+				e = fmt.Errorf("Unable to get absolute form of the archive directory <%s>", config.ArchiveDir)
+				return
+			}
+		default:
+			e = fmt.Errorf("Retention policy for <%s> has unknown action <%s>; options are \"delete\" and \"archive\"", policy.root, policy.action)
+			return
+		}
+
+		policies[policy.root] = policy
+		logging.Log.Noticef("Retention for <%s>: %s run directories (order: %s) when usage exceeds %.3f, until it drops below %.3f", policy.root, policy.action, policy.order, policy.highWater, policy.lowWater)
+	}
+	return
+}
+
+// filesystemUsage returns the used and available bytes of path's filesystem.
+// The available bytes are those available to unprivileged users, as with df.
+func filesystemUsage(path string) (used uint64, avail uint64, e error) {
+	fs := syscall.Statfs_t{}
+	if e = syscall.Statfs(path, &fs); e != nil {
+		return
+	}
+	used = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+	avail = fs.Bavail * uint64(fs.Bsize)
+	return
+}
+
+// usedFraction is the fraction of the filesystem in use, as diopsid reports it
+func usedFraction(used uint64, avail uint64) float64 {
+	return float64(used) / float64(used+avail)
+}
+
+// findRunDirs lists the eligible directories at the policy's depth, in the order they should be removed
+func (policy *retentionPolicy) findRunDirs() (candidates []runDir, e error) {
+	levelDirs := []string{policy.root}
+	for level := 0; level < policy.depth; level++ {
+		var nextLevel []string
+		for _, dirName := range levelDirs {
+			dirContents, readDirErr := ioutil.ReadDir(dirName)
+			if readDirErr != nil {
+				e = readDirErr
+				return
+			}
+			for _, fileInfo := range dirContents {
+				if !fileInfo.IsDir() {
+					continue
+				}
+				subDir := filepath.Join(dirName, fileInfo.Name())
+				if level < policy.depth-1 {
+					nextLevel = append(nextLevel, subDir)
+					continue
+				}
+				candidate := runDir{path: subDir, modTime: fileInfo.ModTime(), sortKey: fileInfo.Name()}
+				if policy.namePattern != nil {
+					submatches := policy.namePattern.FindStringSubmatch(fileInfo.Name())
+					if submatches == nil {
+						continue
+					}
+					if len(submatches) > 1 {
+						candidate.sortKey = submatches[1]
+					} else {
+						candidate.sortKey = submatches[0]
+					}
+				}
+				candidates = append(candidates, candidate)
+			}
+		}
+		levelDirs = nextLevel
+	}
+
+	if policy.order == "name" {
+		sort.SliceStable(candidates, func(i, j int) bool { return sortKeyLess(candidates[i].sortKey, candidates[j].sortKey) })
+	} else {
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].modTime.Before(candidates[j].modTime) })
+	}
+	return
+}
+
+// sortKeyLess orders run-directory names; keys that are both numbers are compared as numbers, so that run 9 comes before run 10
+func sortKeyLess(a string, b string) bool {
+	if !isNumber(a) || !isNumber(b) {
+		return a < b
+	}
+	// comparing the lengths without leading zeros, and then the digits, works for numbers of any size
+	trimmedA, trimmedB := strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(trimmedA) != len(trimmedB) {
+		return len(trimmedA) < len(trimmedB)
+	}
+	return trimmedA < trimmedB
+}
+
+func isNumber(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, char := range key {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isProtected checks whether a run directory is, contains, or is inside an ignored directory, or contains a keep marker.
+// It also returns the size of the directory's contents.
+func (s *sweeper) isProtected(root string, dirName string) (protected bool, reason string, size int64, e error) {
+	ignore := s.currentIgnoreRules()
+	for ancestor := filepath.Dir(dirName); len(ancestor) > len(root); ancestor = filepath.Dir(ancestor) {
+		if ignore.matches(root, ancestor) {
+			return true, fmt.Sprintf("inside ignored directory <%s>", ancestor), 0, nil
+		}
+		if ignore.markerFile != "" {
+			if _, statErr := os.Stat(filepath.Join(ancestor, ignore.markerFile)); statErr == nil {
+				return true, fmt.Sprintf("%s marker in <%s>", ignore.markerFile, ancestor), 0, nil
+			}
+		}
+	}
+	e = filepath.Walk(dirName, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && ignore.matches(root, walkPath) {
+			protected = true
+			reason = fmt.Sprintf("ignored directory <%s>", walkPath)
+			return errProtected
+		}
+		if (info.Name() == keepMarker && !info.IsDir()) || ignore.isMarker(info) {
+			protected = true
+			reason = fmt.Sprintf("%s marker in <%s>", info.Name(), filepath.Dir(walkPath))
+			return errProtected
+		}
+		size += info.Size()
+		return nil
+	})
+	if e == errProtected {
+		e = nil
+	}
+	return
+}
+
+// applyRetention removes run directories, oldest first, while the root's filesystem is above the high-water mark
+func (s *sweeper) applyRetention(policy *retentionPolicy, rs *rootSweep) {
+	used, avail, statErr := filesystemUsage(policy.root)
+	if statErr != nil {
+		logging.Log.Errorf("Unable to get the disk usage for <%s>: %v", policy.root, statErr)
+		rs.addError(policy.root, statErr)
+		return
+	}
+	fraction := usedFraction(used, avail)
+	logging.Log.Debugf("Disk usage for <%s>: %.3f (high-water mark: %.3f)", policy.root, fraction, policy.highWater)
+	if fraction <= policy.highWater {
+		return
+	}
+	logging.Log.Warningf("Disk usage for <%s> is %.3f, above the high-water mark of %.3f; applying retention", policy.root, fraction, policy.highWater)
+
+	// moving directories to an archive on the same filesystem would free nothing
+	if policy.action == retentionArchive {
+		if sameErr := policy.checkArchiveDevice(); sameErr != nil {
+			logging.Log.Errorf("Retention for <%s> will not archive anything: %v", policy.root, sameErr)
+			rs.addError(policy.root, sameErr)
+			return
+		}
+	}
+
+	candidates, findErr := policy.findRunDirs()
+	if findErr != nil {
+		logging.Log.Errorf("Unable to find the run directories in <%s>: %v", policy.root, findErr)
+		rs.addError(policy.root, findErr)
+		return
+	}
+
+	nRemoved := 0
+	for _, candidate := range candidates {
+		if fraction < policy.lowWater || rs.aborted || s.stopRequested() {
+			break
+		}
+		protected, reason, size, protErr := s.isProtected(policy.root, candidate.path)
+		if protErr != nil {
+			logging.Log.Errorf("Unable to check directory <%s>; skipping it: %v", candidate.path, protErr)
+			rs.addError(candidate.path, protErr)
+			continue
+		}
+		if protected {
+			logging.Log.Debugf("Retention is skipping protected directory <%s> (%s)", candidate.path, reason)
+			s.report.addSkipped(candidate.path, candidate.modTime, reason)
+			continue
+		}
+
+		if s.dryRun {
+			logging.Log.Infof("Retention would %s directory <%s> (%d bytes)", policy.action, candidate.path, size)
+			s.report.addRetention(candidate.path, candidate.modTime, policy.action)
+			// project the usage, since nothing is actually freed
+			if uint64(size) > used {
+				size = int64(used)
+			}
+			used -= uint64(size)
+			avail += uint64(size)
+			fraction = usedFraction(used, avail)
+			nRemoved++
+			rs.nRemoved++
+			continue
+		}
+
+		// retention is there to free space, so deleted directories don't go to the root's archive
+		var actErr error
+		if policy.action == retentionArchive {
+			actErr = moveTree(candidate.path, policy.root, policy.archiveDir)
+		} else {
+			actErr = os.RemoveAll(candidate.path)
+		}
+		if actErr != nil {
+			logging.Log.Errorf("Retention was unable to %s directory <%s>: %v", policy.action, candidate.path, actErr)
+			rs.addError(candidate.path, actErr)
+			continue
+		}
+		logging.Log.Infof("Retention: %s directory <%s> (%d bytes)", pastTense(policy.action), candidate.path, size)
+		s.report.addRetention(candidate.path, candidate.modTime, policy.action)
+		nRemoved++
+		rs.nRemoved++
+		s.recordRemoval(rs, candidate.path, removalRetention, policy.action, size, candidate.modTime)
+
+		if used, avail, statErr = filesystemUsage(policy.root); statErr != nil {
+			logging.Log.Errorf("Unable to get the disk usage for <%s>: %v", policy.root, statErr)
+			rs.addError(policy.root, statErr)
+			return
+		}
+		fraction = usedFraction(used, avail)
+	}
+
+	if fraction >= policy.lowWater {
+		logging.Log.Errorf("Retention for <%s> ran out of eligible directories; usage is still %.3f after removing %d", policy.root, fraction, nRemoved)
+		return
+	}
+	logging.Log.Noticef("Retention for <%s> removed %d directories; usage is now %.3f", policy.root, nRemoved, fraction)
+}
+
+// checkArchiveDevice returns an error if the archive directory is on the same filesystem as the root, or it can't be told
+func (policy *retentionPolicy) checkArchiveDevice() (e error) {
+	rootDevice, rootErr := deviceOf(policy.root)
+	if rootErr != nil {
+		e = rootErr
+		return
+	}
+	archiveDevice, archiveErr := deviceOf(policy.archiveDir)
+	if archiveErr != nil {
+		e = archiveErr
+		return
+	}
+	if archiveDevice == rootDevice {
+		e = fmt.Errorf("Archive directory <%s> is on the same filesystem as <%s>", policy.archiveDir, policy.root)
+	}
+	return
+}
+
+// deviceOf returns the device of path's filesystem; if path doesn't exist yet, it's that of the closest directory above it that does
+func deviceOf(path string) (device uint64, e error) {
+	for {
+		info, statErr := os.Stat(path)
+		if statErr == nil {
+			stat, isStat := info.Sys().(*syscall.Stat_t)
+			if !isStat {
+				e = fmt.Errorf("Unable to get the device of <%s>", path)
+				return
+			}
+			device = uint64(stat.Dev)
+			return
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(statErr) || parent == path {
+			e = statErr
+			return
+		}
+		path = parent
+	}
+}
+
+// moveTree moves dirName to the same relative location under destDir that it has under root
+func moveTree(dirName string, root string, destDir string) (e error) {
+	relPath, relErr := filepath.Rel(root, dirName)
+	if relErr != nil {
+		e = relErr
+		return
+	}
+	destName := filepath.Join(destDir, relPath)
+	if e = os.MkdirAll(filepath.Dir(destName), os.ModeDir|0775); e != nil {
+		return
+	}
+	renameErr := os.Rename(dirName, destName)
+	if linkErr, isLinkErr := renameErr.(*os.LinkError); !isLinkErr || (linkErr.Err != syscall.EXDEV && linkErr.Err != syscall.EEXIST && linkErr.Err != syscall.ENOTEMPTY) {
+		e = renameErr
+		return
+	}
+	// the destination is on a different filesystem, or is already there (e.g. a parent of something moved earlier),
+	// so the tree has to be copied into it.  The original is only removed once everything in it has been copied.
+	_, existsErr := os.Lstat(destName)
+	destExisted := existsErr == nil
+	e = filepath.Walk(dirName, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relWalk, _ := filepath.Rel(dirName, walkPath)
+		target := filepath.Join(destName, relWalk)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			linkTarget, linkErr := os.Readlink(walkPath)
+			if linkErr != nil {
+				return linkErr
+			}
+			return os.Symlink(linkTarget, target)
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("Unable to copy special file <%s>", walkPath)
+		}
+		if copyErr := copyFile(walkPath, target); copyErr != nil {
+			return copyErr
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+	if e != nil {
+		// leave the original where it is, and don't leave a partial copy behind
+		if !destExisted {
+			os.RemoveAll(destName)
+		}
+		return
+	}
+	e = os.RemoveAll(dirName)
+	return
+}
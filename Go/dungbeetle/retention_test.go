@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestSortKeyLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"9", "10", true},
+		{"10", "9", false},
+		{"100", "10", false},
+		{"009", "10", true},
+		{"99999999999999999999", "100000000000000000000", true},
+		{"10", "10", false},
+		{"run_10", "run_9", true},
+		{"10", "a", true},
+	}
+	for _, test := range tests {
+		if less := sortKeyLess(test.a, test.b); less != test.less {
+			t.Errorf("sortKeyLess(%q, %q) = %v, want %v", test.a, test.b, less, test.less)
+		}
+	}
+}
+
+func TestFindRunDirsByName(t *testing.T) {
+	root, tempErr := ioutil.TempDir("", "dungbeetle")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"run_100", "run_9", "run_10", "run_2", "calibration"} {
+		if mkdirErr := os.Mkdir(filepath.Join(root, name), 0755); mkdirErr != nil {
+			t.Fatal(mkdirErr)
+		}
+	}
+
+	policy := &retentionPolicy{root: root, depth: 1, order: "name", namePattern: regexp.MustCompile("^run_([0-9]+)$")}
+	candidates, findErr := policy.findRunDirs()
+	if findErr != nil {
+		t.Fatal(findErr)
+	}
+	expected := []string{"run_2", "run_9", "run_10", "run_100"}
+	if len(candidates) != len(expected) {
+		t.Fatalf("Expected %d candidates, got %d: %v", len(expected), len(candidates), candidates)
+	}
+	for iCandidate, candidate := range candidates {
+		if filepath.Base(candidate.path) != expected[iCandidate] {
+			t.Errorf("Candidate %d is <%s>, want <%s>", iCandidate, filepath.Base(candidate.path), expected[iCandidate])
+		}
+	}
+}
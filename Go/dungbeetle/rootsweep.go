@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// pathError records a failure to process one path
+type pathError struct {
+	path string
+	err  error
+}
+
+// rootSweep is the state of one sweep of one root directory.
+// Each root is swept in its own goroutine, so nothing in here is shared between roots.
+type rootSweep struct {
+	root string
+	// snapshot of the sweeper's settings for this root
+	maxAge time.Duration
+	// once more than maxErrors errors have been collected, the rest of the root is skipped for this sweep; 0 means no limit
+	maxErrors int
+	rules     []*fileRule
+	retention *retentionPolicy
+	archive   *archive
+	// the archive bundle this sweep is adding to, if any
+	bundle *bundle
+
+	// items removed (or moved out of the root) by the sweep, the file rules and retention;
+	// an item is a file, an empty directory or a whole run directory, and each counts once
+	nRemoved int
+	nSkipped int
+	// bytes freed by deletions and compression; archived or moved items aren't counted
+	nBytes int64
+	errors []pathError
+	// the sweep stopped early because the error budget ran out
+	aborted bool
+
+	start    time.Time
+	duration time.Duration
+	// the sweep didn't finish within the root timeout; it may still be running
+	stalled bool
+}
+
+// newRootSweep starts a sweep of a root with the settings currently in effect
+func (s *sweeper) newRootSweep(root string) *rootSweep {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return &rootSweep{
+		root:      root,
+		maxAge:    s.maxAge,
+		maxErrors: s.maxErrors,
+		rules:     s.fileRules[root],
+		retention: s.retention[root],
+		archive:   s.archives[root],
+		start:     time.Now(),
+	}
+}
+
+// addError records an error for a path, and marks the sweep as aborted if the error budget is exhausted
+func (rs *rootSweep) addError(path string, err error) {
+	rs.errors = append(rs.errors, pathError{path: path, err: err})
+	if rs.maxErrors > 0 && len(rs.errors) > rs.maxErrors && !rs.aborted {
+		logging.Log.Errorf("More than %d errors in <%s>; skipping the rest of it for this sweep", rs.maxErrors, rs.root)
+		rs.aborted = true
+	}
+}
+
+// closeBundle finishes the archive bundle that the sweep has been adding to, if there is one
+func (rs *rootSweep) closeBundle() {
+	if rs.bundle == nil {
+		return
+	}
+	if closeErr := rs.bundle.close(); closeErr != nil {
+		logging.Log.Errorf("Unable to finish archive bundle <%s>: %v", rs.bundle.name, closeErr)
+		rs.addError(rs.bundle.name, closeErr)
+	} else {
+		logging.Log.Debugf("Finished archive bundle <%s>", rs.bundle.name)
+	}
+	rs.bundle = nil
+}
+
+// sweepSummary collects the results of one sweep of all of the root directories
+type sweepSummary struct {
+	roots    []*rootSweep
+	duration time.Duration
+	// the sweep was cut short by a request to stop
+	interrupted bool
+}
+
+func (summary *sweepSummary) nErrors() (n int) {
+	for _, rs := range summary.roots {
+		n += len(rs.errors)
+	}
+	return
+}
+
+func (summary *sweepSummary) nStalled() (n int) {
+	for _, rs := range summary.roots {
+		if rs.stalled {
+			n++
+		}
+	}
+	return
+}
+
+// exitStatus is the status dungbeetle exits with if this is its last sweep
+func (summary *sweepSummary) exitStatus() int {
+	if summary.nErrors() > 0 || summary.nStalled() > 0 {
+		return exitErrors
+	}
+	return exitClean
+}
+
+// log writes one line per root and one line for the whole sweep
+func (summary *sweepSummary) log() {
+	nRemoved, nSkipped := 0, 0
+	var nBytes int64
+	for _, rs := range summary.roots {
+		switch {
+		case rs.stalled:
+			logging.Log.Errorf("Root <%s>: still running after %v", rs.root, time.Since(rs.start).Truncate(time.Second))
+			continue
+		case len(rs.errors) > 0:
+			var failedPaths []string
+			for _, pathErr := range rs.errors {
+				failedPaths = append(failedPaths, pathErr.path)
+			}
+			status := ""
+			if rs.aborted {
+				status = " (aborted)"
+			}
+			logging.Log.Warningf("Root <%s>%s: %d items removed, %d skipped, %d errors in %v; failed paths: %s", rs.root, status, rs.nRemoved, rs.nSkipped, len(rs.errors), rs.duration.Truncate(time.Millisecond), strings.Join(failedPaths, ", "))
+		default:
+			logging.Log.Infof("Root <%s>: %d items removed, %d skipped in %v", rs.root, rs.nRemoved, rs.nSkipped, rs.duration.Truncate(time.Millisecond))
+		}
+		nRemoved += rs.nRemoved
+		nSkipped += rs.nSkipped
+		nBytes += rs.nBytes
+	}
+
+	if summary.interrupted {
+		logging.Log.Notice("The sweep was interrupted")
+	}
+	message := fmt.Sprintf("Sweep of %d roots finished in %v: %d items removed, %d skipped, %d errors, %d bytes reclaimed", len(summary.roots), summary.duration.Truncate(time.Millisecond), nRemoved, nSkipped, summary.nErrors(), nBytes)
+	if nStalled := summary.nStalled(); nStalled > 0 {
+		logging.Log.Errorf("%s; %d roots stalled", message, nStalled)
+	} else if summary.nErrors() > 0 {
+		logging.Log.Warning(message)
+	} else {
+		logging.Log.Notice(message)
+	}
+}
+
+// checkRootDirs cleans up the root directories and checks that each of them is a directory.
+// The checks run in parallel, each for up to timeout, so that a hung mount can't hold up startup;
+// the roots that fail or time out are logged and left out of usable.  The error is only for roots that are invalid as given.
+func checkRootDirs(rootDirs []string, timeout time.Duration) (allRoots []string, usable []string, e error) {
+	for _, rootDir := range rootDirs {
+		rootDirAbs, rdErr := filepath.Abs(filepath.Clean(rootDir))
+		if rdErr != nil {
+			e = fmt.Errorf("Unable to get absolute form of the root directory <%s>", rootDir)
+			return
+		}
+		allRoots = append(allRoots, rootDirAbs)
+	}
+
+	type rootCheck struct {
+		iRoot int
+		err   error
+	}
+	// buffered, so that a check that returns after the timeout doesn't block forever
+	checks := make(chan rootCheck, len(allRoots))
+	for iRoot, rootDir := range allRoots {
+		go func(iRoot int, rootDir string) {
+			rootDirInfo, statErr := os.Stat(rootDir)
+			if statErr == nil && !rootDirInfo.IsDir() {
+				statErr = fmt.Errorf("not a directory")
+			}
+			checks <- rootCheck{iRoot: iRoot, err: statErr}
+		}(iRoot, rootDir)
+	}
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timedOut = time.After(timeout)
+	}
+	isUsable := make([]bool, len(allRoots))
+	checked := make([]bool, len(allRoots))
+waitLoop:
+	for nChecked := 0; nChecked < len(allRoots); nChecked++ {
+		select {
+		case check := <-checks:
+			checked[check.iRoot] = true
+			if check.err != nil {
+				logging.Log.Errorf("Skipping root directory <%s>: %v", allRoots[check.iRoot], check.err)
+				continue
+			}
+			isUsable[check.iRoot] = true
+		case <-timedOut:
+			break waitLoop
+		}
+	}
+	for iRoot, rootDir := range allRoots {
+		switch {
+		case isUsable[iRoot]:
+			usable = append(usable, rootDir)
+			logging.Log.Noticef("Monitoring <%s>", rootDir)
+		case !checked[iRoot]:
+			logging.Log.Errorf("Skipping root directory <%s>: no response after %v; the mount may be hung", rootDir, timeout)
+		}
+	}
+	return
+}
+
+// busyRoots keeps track of roots whose sweep is still running, so that a stalled root (e.g. a hung NFS mount)
+// isn't swept again until the previous sweep returns
+type busyRoots struct {
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+// claim marks a root as busy; it returns false if the root was already busy
+func (b *busyRoots) claim(root string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.busy == nil {
+		b.busy = make(map[string]bool)
+	}
+	if b.busy[root] {
+		return false
+	}
+	b.busy[root] = true
+	return true
+}
+
+func (b *busyRoots) release(root string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.busy, root)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// emptyDirWatcher uses inotify to keep track of when directories under the root directories become empty,
+// and removes each one once it has been empty for maxAge.
+type emptyDirWatcher struct {
+	watcher    *fsnotify.Watcher
+	sweeper    *sweeper
+	rootDirs   []string
+	isRoot     map[string]bool
+	watched    map[string]bool
+	emptySince map[string]time.Time
+}
+
+// newEmptyDirWatcher adds watches to every directory under rootDirs.
+// Directories that are already empty are considered to have been empty since their modification time.
+func newEmptyDirWatcher(rootDirs []string, theSweeper *sweeper) (w *emptyDirWatcher, e error) {
+	fsWatcher, watcherErr := fsnotify.NewWatcher()
+	if watcherErr != nil {
+		e = watcherErr
+		return
+	}
+	w = &emptyDirWatcher{
+		watcher:    fsWatcher,
+		sweeper:    theSweeper,
+		rootDirs:   rootDirs,
+		isRoot:     make(map[string]bool),
+		watched:    make(map[string]bool),
+		emptySince: make(map[string]time.Time),
+	}
+	for _, rootDir := range rootDirs {
+		w.isRoot[rootDir] = true
+		w.addTree(rootDir, time.Time{})
+	}
+	logging.Log.Noticef("Watching %d directories; %d are currently empty", len(w.watched), len(w.emptySince))
+	return
+}
+
+// addTree watches dirName and all of its subdirectories.
+// If since is zero, an empty directory's modification time is used as the time it became empty.
+func (w *emptyDirWatcher) addTree(dirName string, since time.Time) {
+	ignore := w.sweeper.currentIgnoreRules()
+	if ignore.matches(w.rootOf(dirName), dirName) {
+		logging.Log.Debugf("Ignoring directory <%s>", dirName)
+		return
+	}
+	if addErr := w.watcher.Add(dirName); addErr != nil {
+		// most likely the inotify watch limit; the periodic sweep will still take care of this directory
+		logging.Log.Warningf("Unable to watch directory <%s>: %v", dirName, addErr)
+		return
+	}
+	w.watched[dirName] = true
+
+	dirContents, readDirErr := ioutil.ReadDir(dirName)
+	if readDirErr != nil {
+		logging.Log.Errorf("Unable to read directory <%s>: %v", dirName, readDirErr)
+		return
+	}
+	if len(dirContents) == 0 {
+		w.markEmpty(dirName, since)
+		return
+	}
+	if ignore.hasMarker(dirContents) {
+		logging.Log.Debugf("Keeping directory <%s> and everything below it", dirName)
+		return
+	}
+	for _, fileInfo := range dirContents {
+		if fileInfo.IsDir() {
+			w.addTree(filepath.Join(dirName, fileInfo.Name()), since)
+		}
+	}
+}
+
+// rootOf returns the root directory that dirName is in
+func (w *emptyDirWatcher) rootOf(dirName string) string {
+	for _, rootDir := range w.rootDirs {
+		if dirName == rootDir || strings.HasPrefix(dirName, strings.TrimSuffix(rootDir, string(os.PathSeparator))+string(os.PathSeparator)) {
+			return rootDir
+		}
+	}
+	return ""
+}
+
+// isProtected checks whether dirName, or a directory above it, is ignored or has a keep marker.
+// The ignore list may have been reloaded, or a marker added, since the directory started being tracked.
+func (w *emptyDirWatcher) isProtected(dirName string) bool {
+	ignore := w.sweeper.currentIgnoreRules()
+	root := w.rootOf(dirName)
+	if root == "" {
+		// not under any of the roots, so it's none of our business
+		return true
+	}
+	for ancestor := dirName; len(ancestor) > len(root) && filepath.Dir(ancestor) != ancestor; ancestor = filepath.Dir(ancestor) {
+		if ignore.matches(root, ancestor) {
+			return true
+		}
+		if ignore.markerFile != "" {
+			if _, statErr := os.Stat(filepath.Join(ancestor, ignore.markerFile)); statErr == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markEmpty starts the clock on an empty directory, unless it's a root directory or is already being tracked
+func (w *emptyDirWatcher) markEmpty(dirName string, since time.Time) {
+	if w.isRoot[dirName] {
+		return
+	}
+	if _, isTracked := w.emptySince[dirName]; isTracked {
+		return
+	}
+	if since.IsZero() {
+		since = time.Now()
+		if dirInfo, statErr := os.Stat(dirName); statErr == nil {
+			since = dirInfo.ModTime()
+		}
+	}
+	logging.Log.Debugf("Directory <%s> is empty", dirName)
+	w.emptySince[dirName] = since
+}
+
+// reevaluate checks whether a watched directory is now empty
+func (w *emptyDirWatcher) reevaluate(dirName string) {
+	if !w.watched[dirName] {
+		return
+	}
+	dirContents, readDirErr := ioutil.ReadDir(dirName)
+	if readDirErr != nil {
+		if !os.IsNotExist(readDirErr) {
+			logging.Log.Errorf("Unable to read directory <%s>: %v", dirName, readDirErr)
+		}
+		return
+	}
+	if len(dirContents) == 0 {
+		w.markEmpty(dirName, time.Now())
+	} else {
+		delete(w.emptySince, dirName)
+	}
+}
+
+// forgetTree stops tracking dirName and everything below it
+func (w *emptyDirWatcher) forgetTree(dirName string) {
+	prefix := dirName + string(os.PathSeparator)
+	for watchedDir := range w.watched {
+		if watchedDir == dirName || strings.HasPrefix(watchedDir, prefix) {
+			// the watch is already gone if the directory was deleted, so errors are expected here
+			w.watcher.Remove(watchedDir)
+			delete(w.watched, watchedDir)
+			delete(w.emptySince, watchedDir)
+		}
+	}
+}
+
+func (w *emptyDirWatcher) handleEvent(event fsnotify.Event) {
+	logging.Log.Debugf("Event: %v", event)
+	parentDir := filepath.Dir(event.Name)
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		delete(w.emptySince, parentDir)
+		if info, statErr := os.Lstat(event.Name); statErr == nil && info.IsDir() {
+			w.addTree(event.Name, time.Now())
+		}
+	case event.Op&fsnotify.Remove == fsnotify.Remove, event.Op&fsnotify.Rename == fsnotify.Rename:
+		w.forgetTree(event.Name)
+		w.reevaluate(parentDir)
+	}
+}
+
+// removeExpired removes directories that have been empty for longer than maxAge.
+// They're removed the same way as in a sweep, so they go to the root's archive if it has one,
+// and each root's removals are recorded in a rootSweep of their own; if anything was removed or failed,
+// the pass is logged and published like a sweep.
+// A parent that's emptied by a removal is considered to have been empty since its modification time before the removal,
+// and it's removed in the same pass if that's long enough ago.
+func (w *emptyDirWatcher) removeExpired() {
+	start := time.Now()
+	maxAge := w.sweeper.currentMaxAge()
+	sweeps := make(map[string]*rootSweep)
+	for nRemoved := -1; nRemoved != 0; {
+		nRemoved = 0
+		for dirName, since := range w.emptySince {
+			if time.Since(since) <= maxAge {
+				continue
+			}
+			// make sure nothing slipped in without us noticing
+			dirContents, readDirErr := ioutil.ReadDir(dirName)
+			if readDirErr != nil || len(dirContents) != 0 || w.isProtected(dirName) {
+				delete(w.emptySince, dirName)
+				continue
+			}
+			dirInfo, statErr := os.Lstat(dirName)
+			if statErr != nil {
+				delete(w.emptySince, dirName)
+				continue
+			}
+			root := w.rootOf(dirName)
+			rs, isStarted := sweeps[root]
+			if !isStarted {
+				rs = w.sweeper.newRootSweep(root)
+				sweeps[root] = rs
+			}
+			parentDir := filepath.Dir(dirName)
+			parentInfo, parentErr := os.Stat(parentDir)
+			if !w.sweeper.removeEmpty(dirName, dirName, dirInfo, rs) {
+				continue
+			}
+			nRemoved++
+			w.forgetTree(dirName)
+			if parentErr == nil && w.watched[parentDir] {
+				if parentContents, readErr := ioutil.ReadDir(parentDir); readErr == nil && len(parentContents) == 0 {
+					w.markEmpty(parentDir, parentInfo.ModTime())
+				}
+			}
+			// otherwise the parent is re-evaluated when the removal event arrives
+		}
+	}
+
+	summary := &sweepSummary{}
+	for _, rs := range sweeps {
+		rs.closeBundle()
+		rs.duration = time.Since(rs.start)
+		if rs.nRemoved > 0 || len(rs.errors) > 0 {
+			summary.roots = append(summary.roots, rs)
+		}
+	}
+	if len(summary.roots) == 0 {
+		return
+	}
+	summary.duration = time.Since(start)
+	summary.log()
+	w.sweeper.notifier.publishSweep(summary)
+}
+
+// run handles events until dungbeetle is asked to stop or the watcher fails, and returns the summary of the last full sweep.
+// Expired directories are removed every checkInterval, and a full sweep of the root directories is done every sweepInterval as a safety net.
+func (w *emptyDirWatcher) run(checkInterval time.Duration, sweepInterval time.Duration) (lastSweep *sweepSummary, e error) {
+	defer w.watcher.Close()
+	checkTicker := time.NewTicker(checkInterval)
+	defer checkTicker.Stop()
+	sweepTicker := time.NewTicker(sweepInterval)
+	defer sweepTicker.Stop()
+
+	for {
+		select {
+		case <-w.sweeper.stop:
+			return
+		case event, chanOpen := <-w.watcher.Events:
+			if !chanOpen {
+				e = errors.New("watcher event channel is closed")
+				return
+			}
+			w.handleEvent(event)
+		case watchErr, chanOpen := <-w.watcher.Errors:
+			if !chanOpen {
+				e = errors.New("watcher error channel is closed")
+				return
+			}
+			// this includes queue overflows, after which events have been lost; the next sweep will catch up
+			logging.Log.Errorf("Watcher error: %v", watchErr)
+		case <-checkTicker.C:
+			w.removeExpired()
+		case <-sweepTicker.C:
+			logging.Log.Debug("Starting a full sweep")
+			lastSweep = w.sweeper.sweepRoots(w.rootDirs)
+		}
+	}
+}
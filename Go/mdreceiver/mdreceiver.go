@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	//"sync"
+	"syscall"
 	"time"
 
 	"github.com/kardianos/osext"
@@ -76,6 +77,22 @@ func main() {
 	viper.SetDefault("log-level", "INFO")
 	viper.SetDefault("broker", "localhost")
 	viper.SetDefault("queue", "mdreceiver")
+	viper.SetDefault("allowed-roots", []string{})
+	viper.SetDefault("max-read-bytes", 1048576)
+	viper.SetDefault("max-list-entries", 1000)
+	// validation is off unless schema-dir is set to a directory of <name>.json schemas, which must exist
+	viper.SetDefault("schema-dir", "")
+	// if set, a <file>.provenance.json sidecar is written next to each file
+	viper.SetDefault("write-provenance", false)
+	// if spool-dir is set, writes that fail for a reason that may clear up are kept there and retried, and are
+	// answered with success and "deferred": true rather than with an error
+	viper.SetDefault("spool-dir", "")
+	viper.SetDefault("spool-retry-min", "5s")
+	viper.SetDefault("spool-retry-max", "5m")
+	viper.SetDefault("spool-max-attempts", 0)
+	viper.SetDefault("spool-max-age", "24h")
+	// if metrics-address is set (e.g. ":9102"), Prometheus metrics are served at /metrics on it
+	viper.SetDefault("metrics-address", "")
 
 	// load config
 	if configFile != "" {
@@ -89,8 +106,62 @@ func main() {
 	logging.ConfigureLogging(viper.GetString("log-level"))
 	logging.Log.Infof("Log level: %v", viper.GetString("log-level"))
 
+	// the verify subcommand checks previously-written files against their provenance files, and then exits
+	if flag.Arg(0) == "verify" {
+		if flag.NArg() < 2 {
+			logging.Log.Critical("Usage: mdreceiver [options] verify [path] ...")
+			os.Exit(1)
+		}
+		if nFailed := runVerify(flag.Args()[1:]); nFailed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	broker := viper.GetString("broker")
-	queueName := viper.GetString("queue")
+	// the queue name is a template; see utility.ExpandHostTemplate
+	queueName, queueErr := utility.ExpandHostTemplate(viper.GetString("queue"))
+	if queueErr != nil {
+		logging.Log.Criticalf("Unable to make the queue name: %v", queueErr)
+		os.Exit(1)
+	}
+
+	if rootsErr := setAllowedRoots(viper.GetStringSlice("allowed-roots")); rootsErr != nil {
+		logging.Log.Criticalf("%v", rootsErr)
+		os.Exit(1)
+	}
+	for _, root := range allowedRoots {
+		logging.Log.Noticef("Allowing access to <%s>", root)
+	}
+	maxReadBytes = viper.GetInt64("max-read-bytes")
+	maxListEntries = viper.GetInt("max-list-entries")
+	writeProvenanceFiles = viper.GetBool("write-provenance")
+
+	// failed writes are journaled to the spool directory and retried, if one is given
+	var spool *WriteSpool
+	if spoolDir := viper.GetString("spool-dir"); spoolDir != "" {
+		var spoolErr error
+		if spool, spoolErr = NewWriteSpool(spoolDir, viper.GetDuration("spool-retry-min"), viper.GetDuration("spool-retry-max"), viper.GetInt("spool-max-attempts"), viper.GetDuration("spool-max-age")); spoolErr != nil {
+			logging.Log.Criticalf("%v", spoolErr)
+			os.Exit(1)
+		}
+		logging.Log.Noticef("Spooling failed writes to <%s>", spool.dir)
+		go spool.Run()
+	}
+
+	if schemaErr := loadSchemas(viper.GetString("schema-dir")); schemaErr != nil {
+		logging.Log.Criticalf("%v", schemaErr)
+		os.Exit(1)
+	}
+	if patternErr := setSchemaPatterns(viper.Get("schema-patterns")); patternErr != nil {
+		logging.Log.Criticalf("%v", patternErr)
+		os.Exit(1)
+	}
+
+	// the metrics endpoint is only served if an address is given
+	if metricsAddress := viper.GetString("metrics-address"); metricsAddress != "" {
+		startMetricsServer(metricsAddress, queueName)
+	}
 
 	// check authentication for desired username
 	if authErr := authentication.Load(); authErr != nil {
@@ -179,22 +250,15 @@ receiverLoop:
 						}
 						continue receiverLoop
 					}
-					logging.Log.Debugf("Filename to write: %s", thePath)
-
-					dir, _ := filepath.Split(thePath)
-					// check whether the directory exists
-					_, dirStatErr := os.Stat(dir)
-					if dirStatErr != nil && os.IsNotExist(dirStatErr) {
-						if mkdirErr := os.MkdirAll(dir, os.ModeDir | 0775); mkdirErr != nil {
-							msgText := fmt.Sprintf("Unable to create the directory <%q>", dir)
-							if sendErr := PrepareAndSendReply(service, request, dripline.RCErrHW, msgText, MasterSenderInfo); sendErr != nil {
-								break receiverLoop
-							}
-							continue receiverLoop
+					thePath, allowErr := checkAllowedPath(thePath)
+					if allowErr != nil {
+						if sendErr := PrepareAndSendReply(service, request, dripline.RCErrDripAccessDenied, allowErr.Error(), MasterSenderInfo); sendErr != nil {
+							break receiverLoop
 						}
-						// Add a small delay after creating the new directory so that anything (e.g. Hornet) waiting for that directory can react to it before the JSON file is created
-						time.Sleep(100 * time.Millisecond)
+						continue receiverLoop
 					}
+					logging.Log.Debugf("Filename to write: %s", thePath)
+
 					contentsIfc, hasContents := payloadAsMap["contents"]
 					if ! hasContents {
 						msgText := fmt.Sprintf("No file contents present in the message for <%q>", thePath)
@@ -213,36 +277,90 @@ receiverLoop:
 						continue receiverLoop
 					}
 
-					theFile, fileErr := os.Create(thePath)
-					if fileErr != nil {
-						msgText := fmt.Sprintf("Unable to create the file <%q>", thePath)
-						if sendErr := PrepareAndSendReply(service, request, dripline.RCErrHW, msgText, MasterSenderInfo); sendErr != nil {
+					requestedSchema := ""
+					if _, hasSchema := payloadAsMap["schema"]; hasSchema {
+						var reqSchemaErr error
+						if requestedSchema, reqSchemaErr = getPayloadString(payloadAsMap, "schema"); reqSchemaErr != nil {
+							if sendErr := PrepareAndSendReply(service, request, dripline.RCErrDripPayload, reqSchemaErr.Error(), MasterSenderInfo); sendErr != nil {
+								break receiverLoop
+							}
+							continue receiverLoop
+						}
+					}
+					schemaName, schema, schemaErr := selectSchema(thePath, requestedSchema)
+					if schemaErr != nil {
+						if sendErr := PrepareAndSendReply(service, request, dripline.RCErrDripPayload, schemaErr.Error(), MasterSenderInfo); sendErr != nil {
 							break receiverLoop
 						}
 						continue receiverLoop
 					}
+					if schema != nil {
+						logging.Log.Debugf("Validating contents against schema <%s>", schemaName)
+						violations, valErr := validateContents(schema, encoded)
+						if valErr != nil {
+							msgText := fmt.Sprintf("Unable to validate the file contents for <%q> against schema <%s>: %v", thePath, schemaName, valErr)
+							if sendErr := PrepareAndSendReply(service, request, dripline.RCErrDripPayload, msgText, MasterSenderInfo); sendErr != nil {
+								break receiverLoop
+							}
+							continue receiverLoop
+						}
+						if len(violations) > 0 {
+							msgText := fmt.Sprintf("File contents for <%q> do not conform to schema <%s>: %s", thePath, schemaName, strings.Join(violations, "; "))
+							violationsPayload := map[string]interface{}{"schema": schemaName, "violations": violations}
+							if sendErr := PrepareAndSendReplyWithPayload(service, request, dripline.RCErrDripPayload, msgText, violationsPayload, MasterSenderInfo); sendErr != nil {
+								break receiverLoop
+							}
+							continue receiverLoop
+						}
+					}
 
-					_, writeErr := theFile.Write(encoded)
-					if writeErr != nil {
-						theFile.Close()
-						msgText := fmt.Sprintf("Unable to write to the file <%q>", thePath)
-						if sendErr := PrepareAndSendReply(service, request, dripline.RCErrHW, msgText, MasterSenderInfo); sendErr != nil {
+					hash := hashBytes(encoded)
+					replyPayload := map[string]interface{}{"filename": thePath, "sha256": hash}
+
+					deferWrite := false
+					if spool != nil && spool.HasPending(thePath) {
+						// earlier writes to this file are still waiting in the spool, so this one has to wait behind them
+						logging.Log.Infof("Earlier writes to <%s> are still spooled", thePath)
+						deferWrite = true
+					} else if writeErr := writeMetadataFile(thePath, encoded); writeErr != nil {
+						// only failures that might clear up by themselves are worth spooling
+						if spool == nil || !isTransient(writeErr) {
+							if sendErr := PrepareAndSendReply(service, request, dripline.RCErrHW, writeErr.Error(), MasterSenderInfo); sendErr != nil {
+								break receiverLoop
+							}
+							continue receiverLoop
+						}
+						logging.Log.Warningf("%v", writeErr)
+						deferWrite = true
+					}
+					if deferWrite {
+						if spoolErr := spool.Add(thePath, encoded, hash, request.Message.SenderInfo); spoolErr != nil {
+							msgText := fmt.Sprintf("Unable to write or spool the file <%q>: %v", thePath, spoolErr)
+							if sendErr := PrepareAndSendReply(service, request, dripline.RCErrHW, msgText, MasterSenderInfo); sendErr != nil {
+								break receiverLoop
+							}
+							continue receiverLoop
+						}
+						replyPayload["deferred"] = true
+						msgText := fmt.Sprintf("File write deferred: %q", thePath)
+						if sendErr := PrepareAndSendReplyWithPayload(service, request, dripline.RCSuccess, msgText, replyPayload, MasterSenderInfo); sendErr != nil {
 							break receiverLoop
 						}
 						continue receiverLoop
 					}
 
-					closeErr := theFile.Close()
-					if closeErr != nil {
-						msgText := fmt.Sprintf("Unable to close the file <%q>", thePath)
-						if sendErr := PrepareAndSendReply(service, request, dripline.RCErrHW, msgText, MasterSenderInfo); sendErr != nil {
-							break receiverLoop
+					if writeProvenanceFiles {
+						if provErr := writeProvenance(thePath, hash, newProvenanceSender(request.Message.SenderInfo)); provErr != nil {
+							msgText := fmt.Sprintf("File written, but unable to write the provenance file for <%q>: %v", thePath, provErr)
+							if sendErr := PrepareAndSendReplyWithPayload(service, request, dripline.RCErrHW, msgText, replyPayload, MasterSenderInfo); sendErr != nil {
+								break receiverLoop
+							}
+							continue receiverLoop
 						}
-						continue receiverLoop
 					}
 
 					msgText := fmt.Sprintf("File written: %q", thePath)
-					if sendErr := PrepareAndSendReply(service, request, dripline.RCSuccess, msgText, MasterSenderInfo); sendErr != nil {
+					if sendErr := PrepareAndSendReplyWithPayload(service, request, dripline.RCSuccess, msgText, replyPayload, MasterSenderInfo); sendErr != nil {
 						break receiverLoop
 					}
 
@@ -253,6 +371,42 @@ receiverLoop:
 					}
 					continue receiverLoop
 				}
+			case dripline.MOGet:
+				var instruction string
+				if request.Message.Target != queueName {
+					instruction = strings.TrimPrefix(request.Message.Target, queueName + ".")
+				}
+				logging.Log.Debugf("Get instruction: %s", instruction)
+				payloadAsMap, okPAM := request.Message.Payload.(map[interface{}]interface{})
+				if ! okPAM {
+					if sendErr := PrepareAndSendReply(service, request, dripline.RCErrDripPayload, "Unable to convert payload to map; aborting message", MasterSenderInfo); sendErr != nil {
+						break receiverLoop
+					}
+					continue receiverLoop
+				}
+				var retCode dripline.MsgCodeT
+				var msgText string
+				var result interface{}
+				switch instruction {
+				case "read_json":
+					retCode, msgText, result = readJSON(payloadAsMap)
+				case "list":
+					retCode, msgText, result = listDir(payloadAsMap)
+				case "stat":
+					retCode, msgText, result = statPath(payloadAsMap)
+				case "spool_status":
+					if spool == nil {
+						retCode, msgText = dripline.RCErrDripMethod, "Write spooling is not enabled"
+					} else {
+						pendingWrites := spool.Status()
+						retCode, msgText, result = dripline.RCSuccess, fmt.Sprintf("%d spooled writes pending", len(pendingWrites)), map[string]interface{}{"pending": pendingWrites}
+					}
+				default:
+					retCode, msgText = dripline.RCErrDripMethod, "Incoming request operation instruction not handled: " + instruction
+				}
+				if sendErr := PrepareAndSendReplyWithPayload(service, request, retCode, msgText, result, MasterSenderInfo); sendErr != nil {
+					break receiverLoop
+				}
 			default:
 				message := "Incoming request operation type not handled: " + strconv.FormatUint(uint64(request.MsgOp), 10)
 				if sendErr := PrepareAndSendReply(service, request, dripline.RCErrDripMethod, message, MasterSenderInfo); sendErr != nil {
@@ -266,18 +420,52 @@ receiverLoop:
 	logging.Log.Info("MdReceiver is finished")
 }
 
-func PrepareAndSendReply(service *dripline.AmqpService, request dripline.Request, retCode dripline.MsgCodeT, returnMessage string, senderInfo dripline.SenderInfo) (e error) {
-	e = nil
-	if retCode == dripline.RCSuccess {
-		logging.Log.Debugf("Sending reply: (%v) %s", retCode, returnMessage)
-	} else {
-		logging.Log.Warningf("Sending reply: (%v) %s", retCode, returnMessage)
+// writeMetadataFile writes the encoded contents to thePath, creating the directory if necessary
+func writeMetadataFile(thePath string, encoded []byte) (e error) {
+	dir, _ := filepath.Split(thePath)
+	// check whether the directory exists
+	_, dirStatErr := os.Stat(dir)
+	if dirStatErr != nil && os.IsNotExist(dirStatErr) {
+		if mkdirErr := os.MkdirAll(dir, os.ModeDir | 0775); mkdirErr != nil {
+			e = &writeError{fmt.Sprintf("Unable to create the directory <%q>", dir), mkdirErr}
+			return
+		}
+		directoriesCreatedTotal.Inc()
+		// Add a small delay after creating the new directory so that anything (e.g. Hornet) waiting for that directory can react to it before the JSON file is created
+		time.Sleep(100 * time.Millisecond)
 	}
-	reply := dripline.PrepareReplyToRequest(request, retCode, returnMessage, senderInfo)
-	e = service.SendReply(reply);
-	if e != nil {
-		logging.Log.Errorf("Could not send the reply: %v", e)
+
+	started := time.Now()
+	// the path has been checked, so a symbolic link that appeared since then isn't followed
+	theFile, fileErr := os.OpenFile(thePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0666)
+	if fileErr != nil {
+		e = &writeError{fmt.Sprintf("Unable to create the file <%q>", thePath), fileErr}
+		return
 	}
+
+	_, writeErr := theFile.Write(encoded)
+	if writeErr != nil {
+		theFile.Close()
+		e = &writeError{fmt.Sprintf("Unable to write to the file <%q>", thePath), writeErr}
+		return
+	}
+
+	closeErr := theFile.Close()
+	if closeErr != nil {
+		e = &writeError{fmt.Sprintf("Unable to close the file <%q>", thePath), closeErr}
+		return
+	}
+	recordWrite(len(encoded), started)
 	return
 }
 
+func PrepareAndSendReply(service *dripline.AmqpService, request dripline.Request, retCode dripline.MsgCodeT, returnMessage string, senderInfo dripline.SenderInfo) (e error) {
+	return PrepareAndSendReplyWithPayload(service, request, retCode, returnMessage, nil, senderInfo)
+}
+
+// PrepareAndSendReplyWithPayload counts the request for the metrics, and sends the reply
+func PrepareAndSendReplyWithPayload(service *dripline.AmqpService, request dripline.Request, retCode dripline.MsgCodeT, returnMessage string, payload interface{}, senderInfo dripline.SenderInfo) (e error) {
+	recordRequest(request, retCode)
+	return utility.PrepareAndSendReplyWithPayload(service, request, retCode, returnMessage, payload, senderInfo)
+}
+
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mdreceiver_requests_total",
+			Help: "Number of requests handled, by instruction and return code.",
+		},
+		[]string{"instruction", "return_code"},
+	)
+	bytesWrittenTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mdreceiver_bytes_written_total",
+			Help: "Number of bytes written to metadata files.",
+		},
+	)
+	writeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mdreceiver_write_duration_seconds",
+			Help:    "Time taken to create, write and close a metadata file.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+		},
+	)
+	directoriesCreatedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mdreceiver_directories_created_total",
+			Help: "Number of directories created for metadata files.",
+		},
+	)
+	lastWriteTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mdreceiver_last_successful_write_timestamp_seconds",
+			Help: "Unix time of the last successful metadata-file write.",
+		},
+	)
+)
+
+// metricsQueueName is stripped from request targets to get the instruction label
+var metricsQueueName string
+
+// knownInstructions are the instructions counted under their own label; anything else is counted as "other",
+// so that requests with arbitrary targets can't create any number of label values
+var knownInstructions = map[string]bool{
+	"write_json":   true,
+	"read_json":    true,
+	"list":         true,
+	"stat":         true,
+	"spool_status": true,
+}
+
+// startMetricsServer registers the metrics and serves them at /metrics on the given address
+func startMetricsServer(address string, queueName string) {
+	metricsQueueName = queueName
+	prometheus.MustRegister(requestsTotal, bytesWrittenTotal, writeDuration, directoriesCreatedTotal, lastWriteTimestamp)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if serveErr := http.ListenAndServe(address, mux); serveErr != nil {
+			logging.Log.Errorf("Metrics server stopped: %v", serveErr)
+		}
+	}()
+	logging.Log.Noticef("Serving metrics at <%s/metrics>", address)
+}
+
+// recordRequest counts a request by its instruction and the return code of the reply
+func recordRequest(request dripline.Request, retCode dripline.MsgCodeT) {
+	instruction := strings.TrimPrefix(strings.TrimPrefix(request.Message.Target, metricsQueueName), ".")
+	if !knownInstructions[instruction] {
+		instruction = "other"
+	}
+	requestsTotal.WithLabelValues(instruction, strconv.FormatUint(uint64(retCode), 10)).Inc()
+}
+
+// recordWrite records a successful metadata-file write
+func recordWrite(nBytes int, started time.Time) {
+	writeDuration.Observe(time.Since(started).Seconds())
+	bytesWrittenTotal.Add(float64(nBytes))
+	lastWriteTimestamp.SetToCurrentTime()
+}
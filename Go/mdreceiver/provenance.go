@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// provenanceSuffix is appended to the name of a written file to get the name of its sidecar
+const provenanceSuffix = ".provenance.json"
+
+// writeProvenanceFiles enables writing a sidecar for each file written
+var writeProvenanceFiles bool
+
+type provenanceSender struct {
+	Package  string `json:"package"`
+	Exe      string `json:"exe"`
+	Version  string `json:"version"`
+	Commit   string `json:"commit"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+}
+
+// provenanceRecord is the contents of a sidecar file
+type provenanceRecord struct {
+	Filename     string           `json:"filename"`
+	SHA256       string           `json:"sha256"`
+	Sender       provenanceSender `json:"sender"`
+	Timestamp    string           `json:"timestamp"`
+	ReceiverHost string           `json:"receiver_host"`
+}
+
+// hashBytes returns the hex-encoded SHA-256 of data
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the hex-encoded SHA-256 of a file's contents
+func hashFile(thePath string) (hash string, e error) {
+	theFile, openErr := os.Open(thePath)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	defer theFile.Close()
+
+	hasher := sha256.New()
+	if _, e = io.Copy(hasher, theFile); e != nil {
+		return
+	}
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	return
+}
+
+// newProvenanceSender copies the request's sender info into its serializable form
+func newProvenanceSender(sender dripline.SenderInfo) provenanceSender {
+	return provenanceSender{
+		Package:  sender.Package,
+		Exe:      sender.Exe,
+		Version:  sender.Version,
+		Commit:   sender.Commit,
+		Hostname: sender.Hostname,
+		Username: sender.Username,
+	}
+}
+
+// writeProvenance writes the sidecar for thePath
+func writeProvenance(thePath string, hash string, sender provenanceSender) (e error) {
+	record := provenanceRecord{
+		Filename:     thePath,
+		SHA256:       hash,
+		Sender:       sender,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+		ReceiverHost: MasterSenderInfo.Hostname,
+	}
+	encoded, jsonErr := json.MarshalIndent(record, "", "    ")
+	if jsonErr != nil {
+		e = jsonErr
+		return
+	}
+	e = ioutil.WriteFile(thePath+provenanceSuffix, encoded, 0664)
+	return
+}
+
+// verifyProvenance re-hashes the file described by a single sidecar
+func verifyProvenance(sidecarPath string) (e error) {
+	sidecarData, readErr := ioutil.ReadFile(sidecarPath)
+	if readErr != nil {
+		e = fmt.Errorf("Unable to read the provenance file: %v", readErr)
+		return
+	}
+	var record provenanceRecord
+	if jsonErr := json.Unmarshal(sidecarData, &record); jsonErr != nil {
+		e = fmt.Errorf("Unable to decode the provenance file: %v", jsonErr)
+		return
+	}
+	// The sidecar sits next to its file, so use its location rather than the recorded filename in case the files were moved together
+	thePath := strings.TrimSuffix(sidecarPath, provenanceSuffix)
+	hash, hashErr := hashFile(thePath)
+	if hashErr != nil {
+		e = fmt.Errorf("Unable to hash <%s>: %v", thePath, hashErr)
+		return
+	}
+	if hash != record.SHA256 {
+		e = fmt.Errorf("Hash mismatch for <%s>: recorded %s, found %s", thePath, record.SHA256, hash)
+	}
+	return
+}
+
+// runVerify checks every sidecar found in or under the given paths, and returns the number of files that failed verification
+func runVerify(paths []string) (nFailed int) {
+	nChecked := 0
+	for _, aPath := range paths {
+		walkErr := filepath.Walk(aPath, func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				logging.Log.Errorf("Unable to access <%s>: %v", walkPath, err)
+				nFailed++
+				return nil
+			}
+			if info.IsDir() || !strings.HasSuffix(walkPath, provenanceSuffix) {
+				return nil
+			}
+			nChecked++
+			if verifyErr := verifyProvenance(walkPath); verifyErr != nil {
+				logging.Log.Errorf("%v", verifyErr)
+				nFailed++
+				return nil
+			}
+			logging.Log.Debugf("Verified <%s>", strings.TrimSuffix(walkPath, provenanceSuffix))
+			return nil
+		})
+		if walkErr != nil {
+			logging.Log.Errorf("Unable to walk <%s>: %v", aPath, walkErr)
+			nFailed++
+		}
+	}
+	logging.Log.Noticef("Verification complete: %d files checked, %d failures", nChecked, nFailed)
+	return
+}
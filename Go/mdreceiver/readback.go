@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+	"github.com/project8/swarm/Go/utility"
+)
+
+// allowedRoots holds the cleaned, absolute directories under which mdreceiver may read or write files.
+// If it's empty, any path is allowed.
+var allowedRoots []string
+
+// maxReadBytes limits the size of a file that will be returned by read_json
+var maxReadBytes int64
+
+// maxListEntries limits the number of entries that will be returned by list
+var maxListEntries int
+
+// setAllowedRoots cleans up the list of allowed root directories, resolving any symbolic links in them
+func setAllowedRoots(roots []string) (e error) {
+	allowedRoots = make([]string, 0, len(roots))
+	for _, root := range roots {
+		rootAbs, absErr := filepath.Abs(filepath.Clean(root))
+		if absErr != nil {
+			e = fmt.Errorf("Unable to get absolute form of the allowed root <%s>: %v", root, absErr)
+			return
+		}
+		if rootAbs, e = resolveSymlinks(rootAbs); e != nil {
+			e = fmt.Errorf("Unable to resolve the allowed root <%s>: %v", root, e)
+			return
+		}
+		allowedRoots = append(allowedRoots, rootAbs)
+	}
+	return
+}
+
+// resolveSymlinks resolves the symbolic links in an absolute path.
+// The path doesn't have to exist yet (e.g. a file about to be written), in which case the links in the part that does exist are resolved.
+// A link whose target doesn't exist is an error, since there's no telling where creating the path would end up.
+func resolveSymlinks(absPath string) (resolved string, e error) {
+	existing, rest := absPath, ""
+	for {
+		var evalErr error
+		if resolved, evalErr = filepath.EvalSymlinks(existing); evalErr == nil {
+			resolved = filepath.Join(resolved, rest)
+			return
+		}
+		if !os.IsNotExist(evalErr) {
+			e = evalErr
+			return
+		}
+		if info, statErr := os.Lstat(existing); statErr == nil && info.Mode()&os.ModeSymlink != 0 {
+			e = fmt.Errorf("<%s> is a symbolic link to something that doesn't exist", existing)
+			return
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			resolved = absPath
+			return
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// checkAllowedPath cleans up the path, resolves any symbolic links in it, and verifies that the result is within one of the allowed roots,
+// so that a link inside an allowed root can't be used to get outside of it.
+// The resolved path is returned, so that it's what gets used.
+func checkAllowedPath(thePath string) (cleanPath string, e error) {
+	cleanPath, e = filepath.Abs(filepath.Clean(thePath))
+	if e != nil {
+		return
+	}
+	if len(allowedRoots) == 0 {
+		return
+	}
+	if cleanPath, e = resolveSymlinks(cleanPath); e != nil {
+		e = fmt.Errorf("Unable to resolve the path <%s>: %v", thePath, e)
+		return
+	}
+	for _, root := range allowedRoots {
+		if cleanPath == root || strings.HasPrefix(cleanPath, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator)) {
+			return
+		}
+	}
+	e = fmt.Errorf("Path <%s> is not within an allowed root directory", cleanPath)
+	return
+}
+
+// getPayloadString extracts a string-valued field from a request payload
+func getPayloadString(payloadAsMap map[interface{}]interface{}, key string) (value string, e error) {
+	valueIfc, hasValue := payloadAsMap[key]
+	if !hasValue {
+		e = fmt.Errorf("No %s present in message", key)
+		return
+	}
+	value, e = utility.TryConvertToString(valueIfc)
+	if e != nil {
+		e = fmt.Errorf("Unable to convert %s to string", key)
+	}
+	return
+}
+
+// fileInfoToMap converts the relevant parts of a FileInfo to a reply-payload map
+func fileInfoToMap(info os.FileInfo) map[string]interface{} {
+	infoMap := make(map[string]interface{})
+	infoMap["name"] = info.Name()
+	infoMap["size"] = info.Size()
+	infoMap["mtime"] = info.ModTime().Format(time.RFC3339)
+	infoMap["is_dir"] = info.IsDir()
+	infoMap["mode"] = info.Mode().String()
+	return infoMap
+}
+
+// readJSON returns the decoded contents of a JSON file.
+// Payload fields: "filename"
+func readJSON(payloadAsMap map[interface{}]interface{}) (retCode dripline.MsgCodeT, msgText string, result interface{}) {
+	thePath, fnErr := getPayloadString(payloadAsMap, "filename")
+	if fnErr != nil {
+		return dripline.RCErrDripPayload, fnErr.Error(), nil
+	}
+	thePath, allowErr := checkAllowedPath(thePath)
+	if allowErr != nil {
+		return dripline.RCErrDripAccessDenied, allowErr.Error(), nil
+	}
+	logging.Log.Debugf("Filename to read: %s", thePath)
+
+	fileInfo, statErr := os.Stat(thePath)
+	if statErr != nil {
+		return dripline.RCErrDripValue, fmt.Sprintf("Unable to stat the file <%q>", thePath), nil
+	}
+	if fileInfo.IsDir() {
+		return dripline.RCErrDripValue, fmt.Sprintf("Path is a directory: <%q>", thePath), nil
+	}
+	if fileInfo.Size() > maxReadBytes {
+		return dripline.RCErrDripValue, fmt.Sprintf("File <%q> is too large to return (%d bytes; limit is %d bytes)", thePath, fileInfo.Size(), maxReadBytes), nil
+	}
+
+	fileData, readErr := ioutil.ReadFile(thePath)
+	if readErr != nil {
+		return dripline.RCErrHW, fmt.Sprintf("Unable to read the file <%q>", thePath), nil
+	}
+	decoded, jsonErr := utility.JSONToIfc(fileData)
+	if jsonErr != nil {
+		return dripline.RCErrDripValue, fmt.Sprintf("Unable to decode the JSON in <%q>: %v", thePath, jsonErr), nil
+	}
+
+	return dripline.RCSuccess, fmt.Sprintf("File read: %q", thePath), decoded
+}
+
+// listDir returns the contents of a directory, optionally filtered by a glob pattern.
+// Payload fields: "path", "pattern" (optional)
+func listDir(payloadAsMap map[interface{}]interface{}) (retCode dripline.MsgCodeT, msgText string, result interface{}) {
+	thePath, pathErr := getPayloadString(payloadAsMap, "path")
+	if pathErr != nil {
+		return dripline.RCErrDripPayload, pathErr.Error(), nil
+	}
+	thePath, allowErr := checkAllowedPath(thePath)
+	if allowErr != nil {
+		return dripline.RCErrDripAccessDenied, allowErr.Error(), nil
+	}
+	pattern := "*"
+	if _, hasPattern := payloadAsMap["pattern"]; hasPattern {
+		var patErr error
+		if pattern, patErr = getPayloadString(payloadAsMap, "pattern"); patErr != nil {
+			return dripline.RCErrDripPayload, patErr.Error(), nil
+		}
+	}
+	if _, matchErr := filepath.Match(pattern, ""); matchErr != nil {
+		return dripline.RCErrDripValue, fmt.Sprintf("Invalid pattern <%s>: %v", pattern, matchErr), nil
+	}
+	logging.Log.Debugf("Directory to list: %s (pattern: %s)", thePath, pattern)
+
+	dirContents, readDirErr := ioutil.ReadDir(thePath)
+	if readDirErr != nil {
+		return dripline.RCErrDripValue, fmt.Sprintf("Unable to read the directory <%q>", thePath), nil
+	}
+
+	entries := make([]interface{}, 0, len(dirContents))
+	truncated := false
+	for _, info := range dirContents {
+		if matched, _ := filepath.Match(pattern, info.Name()); !matched {
+			continue
+		}
+		if len(entries) >= maxListEntries {
+			truncated = true
+			break
+		}
+		entries = append(entries, fileInfoToMap(info))
+	}
+
+	listing := make(map[string]interface{})
+	listing["path"] = thePath
+	listing["entries"] = entries
+	listing["truncated"] = truncated
+	return dripline.RCSuccess, fmt.Sprintf("Directory listed: %q (%d entries)", thePath, len(entries)), listing
+}
+
+// statPath returns information about a single file or directory.
+// Payload fields: "path"
+func statPath(payloadAsMap map[interface{}]interface{}) (retCode dripline.MsgCodeT, msgText string, result interface{}) {
+	thePath, pathErr := getPayloadString(payloadAsMap, "path")
+	if pathErr != nil {
+		return dripline.RCErrDripPayload, pathErr.Error(), nil
+	}
+	thePath, allowErr := checkAllowedPath(thePath)
+	if allowErr != nil {
+		return dripline.RCErrDripAccessDenied, allowErr.Error(), nil
+	}
+
+	fileInfo, statErr := os.Stat(thePath)
+	if statErr != nil {
+		return dripline.RCErrDripValue, fmt.Sprintf("Unable to stat <%q>", thePath), nil
+	}
+
+	infoMap := fileInfoToMap(fileInfo)
+	infoMap["path"] = thePath
+	return dripline.RCSuccess, fmt.Sprintf("Path found: %q", thePath), infoMap
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAllowedPath(t *testing.T) {
+	base, tempErr := ioutil.TempDir("", "mdreceiver")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(base)
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(base, "data", "sub"), filepath.Join(base, "data2"), outside} {
+		if mkdirErr := os.MkdirAll(dir, 0755); mkdirErr != nil {
+			t.Fatal(mkdirErr)
+		}
+	}
+	// a link out of the root, a dangling link out of the root, and an allowed root that's reached through a link
+	os.Symlink(outside, filepath.Join(base, "data", "escape"))
+	os.Symlink(filepath.Join(outside, "missing", "x"), filepath.Join(base, "data", "dangling"))
+	os.Symlink(filepath.Join(base, "data"), filepath.Join(base, "link"))
+	if rootsErr := setAllowedRoots([]string{filepath.Join(base, "link")}); rootsErr != nil {
+		t.Fatal(rootsErr)
+	}
+	defer setAllowedRoots(nil)
+
+	tests := map[string]bool{
+		"data":                 true,
+		"data/sub":             true,
+		"data/sub/new/file.js": true,
+		"link/sub/../x.json":   true,
+		"data2/x.json":         false,
+		"data/escape/x.json":   false,
+		"data/escape/new/x":    false,
+		"data/dangling":        false,
+		"data/dangling/x.json": false,
+	}
+	for path, allowed := range tests {
+		resolved, checkErr := checkAllowedPath(filepath.Join(base, path))
+		if (checkErr == nil) != allowed {
+			t.Errorf("<%s>: allowed should be %v; got <%s>, %v", path, allowed, resolved, checkErr)
+		}
+	}
+}
+
+func TestWriteMetadataFileDoesNotFollowLinks(t *testing.T) {
+	base, tempErr := ioutil.TempDir("", "mdreceiver")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(base)
+	target := filepath.Join(base, "target")
+	link := filepath.Join(base, "link.json")
+	os.Symlink(target, link)
+	if writeErr := writeMetadataFile(link, []byte("{}")); writeErr == nil {
+		t.Errorf("Writing through a symbolic link should fail")
+	}
+	if _, statErr := os.Stat(target); !os.IsNotExist(statErr) {
+		t.Errorf("The link's target was created")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/project8/swarm/Go/logging"
+	"github.com/project8/swarm/Go/utility"
+)
+
+// schemaPattern associates a filename glob with a schema name
+type schemaPattern struct {
+	Pattern string
+	Schema  string
+}
+
+// schemas holds the compiled schemas, keyed by the schema filename without the .json extension
+var schemas map[string]*gojsonschema.Schema
+
+// schemaPatterns is checked in order; the first pattern matching the filename selects the schema
+var schemaPatterns []schemaPattern
+
+// loadSchemas compiles every .json file in schemaDir
+func loadSchemas(schemaDir string) (e error) {
+	schemas = make(map[string]*gojsonschema.Schema)
+	if schemaDir == "" {
+		return
+	}
+	schemaDirAbs, absErr := filepath.Abs(filepath.Clean(schemaDir))
+	if absErr != nil {
+		e = fmt.Errorf("Unable to get absolute form of the schema directory <%s>: %v", schemaDir, absErr)
+		return
+	}
+	dirContents, readDirErr := ioutil.ReadDir(schemaDirAbs)
+	if readDirErr != nil {
+		e = fmt.Errorf("Unable to read the schema directory <%s>: %v", schemaDirAbs, readDirErr)
+		return
+	}
+	for _, fileInfo := range dirContents {
+		if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".json" {
+			continue
+		}
+		schemaPath := filepath.Join(schemaDirAbs, fileInfo.Name())
+		schema, schemaErr := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + schemaPath))
+		if schemaErr != nil {
+			e = fmt.Errorf("Unable to load the schema <%s>: %v", schemaPath, schemaErr)
+			return
+		}
+		schemaName := strings.TrimSuffix(fileInfo.Name(), ".json")
+		schemas[schemaName] = schema
+		logging.Log.Noticef("Loaded schema <%s>", schemaName)
+	}
+	return
+}
+
+// setSchemaPatterns reads the pattern list from its configuration form, a list of {"pattern": ..., "schema": ...} objects
+func setSchemaPatterns(patternsIfc interface{}) (e error) {
+	schemaPatterns = nil
+	if patternsIfc == nil {
+		return
+	}
+	patternList, okList := patternsIfc.([]interface{})
+	if !okList {
+		e = fmt.Errorf("schema-patterns must be a list")
+		return
+	}
+	for _, entryIfc := range patternList {
+		entry, okEntry := entryIfc.(map[string]interface{})
+		if !okEntry {
+			e = fmt.Errorf("Each entry in schema-patterns must have a pattern and a schema")
+			return
+		}
+		pattern, patErr := utility.TryConvertToString(entry["pattern"])
+		schemaName, schErr := utility.TryConvertToString(entry["schema"])
+		if patErr != nil || schErr != nil {
+			e = fmt.Errorf("Each entry in schema-patterns must have a pattern and a schema")
+			return
+		}
+		if _, matchErr := filepath.Match(pattern, ""); matchErr != nil {
+			e = fmt.Errorf("Invalid schema pattern <%s>: %v", pattern, matchErr)
+			return
+		}
+		if _, hasSchema := schemas[schemaName]; !hasSchema {
+			e = fmt.Errorf("Schema <%s> for pattern <%s> was not loaded", schemaName, pattern)
+			return
+		}
+		schemaPatterns = append(schemaPatterns, schemaPattern{Pattern: pattern, Schema: schemaName})
+		logging.Log.Noticef("Files matching <%s> will be validated with schema <%s>", pattern, schemaName)
+	}
+	return
+}
+
+// selectSchema determines which schema (if any) applies to a write.
+// An explicitly requested schema takes precedence over the filename patterns.
+// The pattern is matched against both the full path and the base filename.
+func selectSchema(thePath string, requestedSchema string) (schemaName string, schema *gojsonschema.Schema, e error) {
+	if requestedSchema != "" {
+		schemaName = strings.TrimSuffix(requestedSchema, ".json")
+		var hasSchema bool
+		if schema, hasSchema = schemas[schemaName]; !hasSchema {
+			e = fmt.Errorf("Unknown schema requested: <%s>", requestedSchema)
+		}
+		return
+	}
+	baseName := filepath.Base(thePath)
+	for _, sp := range schemaPatterns {
+		matchedFull, _ := filepath.Match(sp.Pattern, thePath)
+		matchedBase, _ := filepath.Match(sp.Pattern, baseName)
+		if matchedFull || matchedBase {
+			schemaName = sp.Schema
+			schema = schemas[schemaName]
+			return
+		}
+	}
+	return
+}
+
+// validateContents checks the JSON-encoded file contents against a schema and returns a list of violations
+func validateContents(schema *gojsonschema.Schema, encoded []byte) (violations []string, e error) {
+	result, valErr := schema.Validate(gojsonschema.NewBytesLoader(encoded))
+	if valErr != nil {
+		e = valErr
+		return
+	}
+	for _, resErr := range result.Errors() {
+		violations = append(violations, resErr.String())
+	}
+	return
+}
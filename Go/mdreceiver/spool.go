@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// spoolEntry is the journaled form of a write that could not be completed
+type spoolEntry struct {
+	Filename string           `json:"filename"`
+	Contents []byte           `json:"contents"`
+	SHA256   string           `json:"sha256"`
+	Sender   provenanceSender `json:"sender"`
+	Received string           `json:"received"`
+}
+
+// spoolStatus is the in-memory bookkeeping for a spooled write
+type spoolStatus struct {
+	filename  string
+	received  string
+	attempts  int
+	lastError string
+}
+
+// Spooled writes that are given up on are moved to deadLetterDir, and entries that can't be read to quarantineDir;
+// both are subdirectories of the spool directory, and are left for someone to look at.
+const (
+	deadLetterDir = "dead-letter"
+	quarantineDir = "quarantine"
+)
+
+// writeError is a failed write; the underlying error is kept so that it can be told whether the write is worth retrying
+type writeError struct {
+	text  string
+	cause error
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.text, e.cause)
+}
+
+// isTransient reports whether a failed write might succeed later, e.g. once a full disk has been cleared or a network
+// filesystem is back; errors like a permission problem or a bad path won't go away by themselves, so there's no point
+// in spooling those writes
+func isTransient(err error) bool {
+	for {
+		switch typedErr := err.(type) {
+		case *writeError:
+			err = typedErr.cause
+		case *os.PathError:
+			err = typedErr.Err
+		case *os.LinkError:
+			err = typedErr.Err
+		case *os.SyscallError:
+			err = typedErr.Err
+		case syscall.Errno:
+			switch typedErr {
+			case syscall.EIO, syscall.ENOSPC, syscall.EDQUOT, syscall.EROFS, syscall.ESTALE, syscall.ETIMEDOUT,
+				syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ENOTCONN, syscall.ENODEV, syscall.ENXIO,
+				syscall.EHOSTDOWN, syscall.EHOSTUNREACH, syscall.ENETDOWN, syscall.ENETUNREACH:
+				return true
+			}
+			return false
+		default:
+			return false
+		}
+	}
+}
+
+// WriteSpool journals failed writes to a local directory and retries them in order until they succeed.
+// A write is given up on once it has been tried maxAttempts times or has been spooled for longer than maxAge
+// (either limit is off if zero), or as soon as it fails with an error that isn't transient.
+type WriteSpool struct {
+	dir          string
+	retryMin     time.Duration
+	retryMax     time.Duration
+	maxAttempts  int
+	maxAge       time.Duration
+	lock         sync.Mutex
+	pending      map[string]*spoolStatus // keyed by spool-file name
+	pendingPaths map[string]int          // number of pending writes for each target path
+	wake         chan bool
+	sequence     uint64
+}
+
+// NewWriteSpool creates the spool directory if needed and picks up any writes left in it by a previous run.
+// Entries that can't be read are moved to the quarantine directory.
+func NewWriteSpool(dir string, retryMin, retryMax time.Duration, maxAttempts int, maxAge time.Duration) (spool *WriteSpool, e error) {
+	dirAbs, absErr := filepath.Abs(filepath.Clean(dir))
+	if absErr != nil {
+		e = fmt.Errorf("Unable to get absolute form of the spool directory <%s>: %v", dir, absErr)
+		return
+	}
+	if mkdirErr := os.MkdirAll(dirAbs, os.ModeDir|0775); mkdirErr != nil {
+		e = fmt.Errorf("Unable to create the spool directory <%s>: %v", dirAbs, mkdirErr)
+		return
+	}
+	spool = &WriteSpool{
+		dir:          dirAbs,
+		retryMin:     retryMin,
+		retryMax:     retryMax,
+		maxAttempts:  maxAttempts,
+		maxAge:       maxAge,
+		pending:      make(map[string]*spoolStatus),
+		pendingPaths: make(map[string]int),
+		wake:         make(chan bool, 1),
+	}
+
+	spoolFiles, listErr := spool.spoolFiles()
+	if listErr != nil {
+		e = listErr
+		return
+	}
+	for _, spoolFile := range spoolFiles {
+		entry, readErr := spool.readEntry(spoolFile)
+		if readErr != nil {
+			logging.Log.Errorf("%v", readErr)
+			spool.setAside(spoolFile, quarantineDir)
+			continue
+		}
+		spool.pending[spoolFile] = &spoolStatus{filename: entry.Filename, received: entry.Received}
+		spool.pendingPaths[entry.Filename]++
+	}
+	if len(spool.pending) > 0 {
+		logging.Log.Noticef("Found %d spooled writes in <%s>", len(spool.pending), dirAbs)
+	}
+	return
+}
+
+// spoolFiles returns the names of the journaled writes, oldest first
+func (spool *WriteSpool) spoolFiles() (names []string, e error) {
+	dirContents, readDirErr := ioutil.ReadDir(spool.dir)
+	if readDirErr != nil {
+		e = fmt.Errorf("Unable to read the spool directory <%s>: %v", spool.dir, readDirErr)
+		return
+	}
+	for _, fileInfo := range dirContents {
+		if !fileInfo.IsDir() && filepath.Ext(fileInfo.Name()) == ".json" {
+			names = append(names, fileInfo.Name())
+		}
+	}
+	// the names start with a zero-padded timestamp, so lexical order is chronological order
+	sort.Strings(names)
+	return
+}
+
+func (spool *WriteSpool) readEntry(spoolFile string) (entry spoolEntry, e error) {
+	entryData, readErr := ioutil.ReadFile(filepath.Join(spool.dir, spoolFile))
+	if readErr != nil {
+		e = fmt.Errorf("Unable to read the spooled write <%s>: %v", spoolFile, readErr)
+		return
+	}
+	if jsonErr := json.Unmarshal(entryData, &entry); jsonErr != nil {
+		e = fmt.Errorf("Unable to decode the spooled write <%s>: %v", spoolFile, jsonErr)
+	}
+	return
+}
+
+// HasPending reports whether any writes to thePath are waiting in the spool
+func (spool *WriteSpool) HasPending(thePath string) bool {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	return spool.pendingPaths[thePath] > 0
+}
+
+// Add journals a write to the spool
+func (spool *WriteSpool) Add(thePath string, encoded []byte, hash string, sender dripline.SenderInfo) (e error) {
+	now := time.Now()
+	entry := spoolEntry{
+		Filename: thePath,
+		Contents: encoded,
+		SHA256:   hash,
+		Sender:   newProvenanceSender(sender),
+		Received: now.UTC().Format(time.RFC3339Nano),
+	}
+	entryData, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		e = jsonErr
+		return
+	}
+
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	spool.sequence++
+	spoolFile := fmt.Sprintf("%020d-%06d.json", now.UnixNano(), spool.sequence%1000000)
+	// write to a temporary name first so that a partial entry is never replayed
+	tmpPath := filepath.Join(spool.dir, spoolFile+".tmp")
+	if e = ioutil.WriteFile(tmpPath, entryData, 0664); e != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if e = os.Rename(tmpPath, filepath.Join(spool.dir, spoolFile)); e != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	spool.pending[spoolFile] = &spoolStatus{filename: thePath, received: entry.Received}
+	spool.pendingPaths[thePath]++
+	logging.Log.Infof("Spooled write to <%s> as <%s>", thePath, spoolFile)
+
+	select {
+	case spool.wake <- true:
+	default:
+	}
+	return
+}
+
+// Status lists the pending writes, oldest first
+func (spool *WriteSpool) Status() []interface{} {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	spoolFiles := make([]string, 0, len(spool.pending))
+	for spoolFile := range spool.pending {
+		spoolFiles = append(spoolFiles, spoolFile)
+	}
+	sort.Strings(spoolFiles)
+
+	entries := make([]interface{}, 0, len(spoolFiles))
+	for _, spoolFile := range spoolFiles {
+		status := spool.pending[spoolFile]
+		entryMap := make(map[string]interface{})
+		entryMap["spool_file"] = spoolFile
+		entryMap["filename"] = status.filename
+		entryMap["received"] = status.received
+		entryMap["attempts"] = status.attempts
+		entryMap["last_error"] = status.lastError
+		entries = append(entries, entryMap)
+	}
+	return entries
+}
+
+// replayOnce attempts the pending writes in order.
+// A write that fails holds up the later writes to the same file, so that they land in order, but not those to other files.
+// It returns true if the spool is empty afterwards.
+func (spool *WriteSpool) replayOnce() bool {
+	spoolFiles, listErr := spool.spoolFiles()
+	if listErr != nil {
+		logging.Log.Errorf("%v", listErr)
+		return false
+	}
+	held := make(map[string]bool)
+	for _, spoolFile := range spoolFiles {
+		spool.lock.Lock()
+		status, isPending := spool.pending[spoolFile]
+		spool.lock.Unlock()
+		if !isPending {
+			continue
+		}
+
+		entry, readErr := spool.readEntry(spoolFile)
+		if readErr != nil {
+			logging.Log.Errorf("%v", readErr)
+			spool.setAside(spoolFile, quarantineDir)
+			continue
+		}
+		if held[entry.Filename] {
+			continue
+		}
+
+		writeErr := writeMetadataFile(entry.Filename, entry.Contents)
+		if writeErr == nil && writeProvenanceFiles {
+			writeErr = writeProvenance(entry.Filename, entry.SHA256, entry.Sender)
+		}
+
+		spool.lock.Lock()
+		status.attempts++
+		attempts := status.attempts
+		if writeErr != nil {
+			status.lastError = writeErr.Error()
+			spool.lock.Unlock()
+			logging.Log.Warningf("Spooled write to <%s> failed (attempt %d): %v", entry.Filename, attempts, writeErr)
+			if reason := spool.giveUpReason(writeErr, attempts, entry.Received); reason != "" {
+				logging.Log.Errorf("Giving up on the spooled write to <%s> (%s); it's kept in <%s>", entry.Filename, reason, filepath.Join(spool.dir, deadLetterDir))
+				spool.setAside(spoolFile, deadLetterDir)
+				continue
+			}
+			held[entry.Filename] = true
+			continue
+		}
+		if remErr := os.Remove(filepath.Join(spool.dir, spoolFile)); remErr != nil {
+			logging.Log.Errorf("Unable to remove the spooled write <%s>: %v", spoolFile, remErr)
+		}
+		spool.forget(spoolFile)
+		spool.lock.Unlock()
+		logging.Log.Noticef("Spooled write to <%s> completed after %d attempts", entry.Filename, attempts)
+	}
+	return len(held) == 0
+}
+
+// giveUpReason says why a failed write shouldn't be retried, or returns an empty string if it should
+func (spool *WriteSpool) giveUpReason(writeErr error, attempts int, received string) string {
+	if !isTransient(writeErr) {
+		return "the error isn't transient"
+	}
+	if spool.maxAttempts > 0 && attempts >= spool.maxAttempts {
+		return fmt.Sprintf("%d attempts", attempts)
+	}
+	if receivedTime, parseErr := time.Parse(time.RFC3339Nano, received); parseErr == nil && spool.maxAge > 0 && time.Since(receivedTime) > spool.maxAge {
+		return fmt.Sprintf("spooled for more than %v", spool.maxAge)
+	}
+	return ""
+}
+
+// setAside moves a spool entry into a subdirectory of the spool, where it won't be replayed
+func (spool *WriteSpool) setAside(spoolFile string, subDir string) {
+	asideDir := filepath.Join(spool.dir, subDir)
+	moveErr := os.MkdirAll(asideDir, os.ModeDir|0775)
+	if moveErr == nil {
+		moveErr = os.Rename(filepath.Join(spool.dir, spoolFile), filepath.Join(asideDir, spoolFile))
+	}
+	if moveErr != nil {
+		// it's still dropped from the pending writes, so it won't be tried again until the next restart
+		logging.Log.Errorf("Unable to move the spooled write <%s> to <%s>: %v", spoolFile, asideDir, moveErr)
+	} else {
+		logging.Log.Warningf("Moved the spooled write <%s> to <%s>", spoolFile, asideDir)
+	}
+	spool.lock.Lock()
+	spool.forget(spoolFile)
+	spool.lock.Unlock()
+}
+
+// forget drops a spool entry from the pending writes; the lock must be held
+func (spool *WriteSpool) forget(spoolFile string) {
+	status, isPending := spool.pending[spoolFile]
+	if !isPending {
+		return
+	}
+	delete(spool.pending, spoolFile)
+	spool.pendingPaths[status.filename]--
+	if spool.pendingPaths[status.filename] <= 0 {
+		delete(spool.pendingPaths, status.filename)
+	}
+}
+
+// Run replays the spool forever, backing off exponentially while writes continue to fail
+func (spool *WriteSpool) Run() {
+	backoff := spool.retryMin
+	for {
+		spool.lock.Lock()
+		nPending := len(spool.pending)
+		spool.lock.Unlock()
+
+		if nPending == 0 {
+			// nothing to do until a write is spooled
+			backoff = spool.retryMin
+			<-spool.wake
+		} else {
+			time.Sleep(backoff)
+		}
+
+		if spool.replayOnce() {
+			backoff = spool.retryMin
+			continue
+		}
+		backoff *= 2
+		if backoff > spool.retryMax {
+			backoff = spool.retryMax
+		}
+		logging.Log.Infof("Spooled writes remain; retrying in %v", backoff)
+	}
+}
@@ -0,0 +1,31 @@
+// Dripline reply utilities
+package utility
+
+import (
+	"github.com/project8/dripline-go/dripline"
+
+	"github.com/project8/swarm/Go/logging"
+)
+
+// PrepareAndSendReply sends a reply to a request, with no payload
+func PrepareAndSendReply(service *dripline.AmqpService, request dripline.Request, retCode dripline.MsgCodeT, returnMessage string, senderInfo dripline.SenderInfo) (e error) {
+	return PrepareAndSendReplyWithPayload(service, request, retCode, returnMessage, nil, senderInfo)
+}
+
+// PrepareAndSendReplyWithPayload sends a reply to a request; a nil payload is left out
+func PrepareAndSendReplyWithPayload(service *dripline.AmqpService, request dripline.Request, retCode dripline.MsgCodeT, returnMessage string, payload interface{}, senderInfo dripline.SenderInfo) (e error) {
+	if retCode == dripline.RCSuccess {
+		logging.Log.Debugf("Sending reply: (%v) %s", retCode, returnMessage)
+	} else {
+		logging.Log.Warningf("Sending reply: (%v) %s", retCode, returnMessage)
+	}
+	reply := dripline.PrepareReplyToRequest(request, retCode, returnMessage, senderInfo)
+	if payload != nil {
+		reply.Message.Payload = payload
+	}
+	e = service.SendReply(reply)
+	if e != nil {
+		logging.Log.Errorf("Could not send the reply: %v", e)
+	}
+	return
+}
@@ -0,0 +1,85 @@
+// Template utilities for routing keys and queue names
+package utility
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// ExpandTemplate replaces each {variable} in template with its value from vars; "{{" and "}}" stand for literal braces.
+// An unknown variable is an error, so that a typo doesn't silently end up in a routing key.
+func ExpandTemplate(template string, vars map[string]string) (expanded string, e error) {
+	var result strings.Builder
+	for i := 0; i < len(template); i++ {
+		switch {
+		case strings.HasPrefix(template[i:], "{{"):
+			result.WriteByte('{')
+			i++
+		case strings.HasPrefix(template[i:], "}}"):
+			result.WriteByte('}')
+			i++
+		case template[i] == '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				e = fmt.Errorf("Unterminated variable in template <%s>", template)
+				return
+			}
+			name := template[i+1 : i+end]
+			value, known := vars[name]
+			if !known {
+				e = fmt.Errorf("Unknown variable <%s> in template <%s>", name, template)
+				return
+			}
+			result.WriteString(value)
+			i += end
+		default:
+			result.WriteByte(template[i])
+		}
+	}
+	expanded = result.String()
+	return
+}
+
+// TemplateUses checks whether template refers to a variable
+func TemplateUses(template string, name string) bool {
+	return strings.Contains(strings.NewReplacer("{{", "", "}}", "").Replace(template), "{"+name+"}")
+}
+
+// HostVariables returns the template variables that describe where a program is running:
+//   - hostname: the full hostname
+//   - short_hostname: the hostname up to the first dot; "machine" is the same thing
+//   - user: the name of the user running the program
+func HostVariables() (vars map[string]string, e error) {
+	hostname, hostErr := os.Hostname()
+	if hostErr != nil {
+		e = hostErr
+		return
+	}
+	currentUser, userErr := user.Current()
+	if userErr != nil {
+		e = userErr
+		return
+	}
+	shortHostname := strings.SplitN(hostname, ".", 2)[0]
+
+	vars = map[string]string{
+		"hostname":       hostname,
+		"short_hostname": shortHostname,
+		"machine":        shortHostname,
+		"user":           currentUser.Username,
+	}
+	return
+}
+
+// ExpandHostTemplate expands a template that can only use the HostVariables
+func ExpandHostTemplate(template string) (expanded string, e error) {
+	vars, varsErr := HostVariables()
+	if varsErr != nil {
+		e = varsErr
+		return
+	}
+	expanded, e = ExpandTemplate(template, vars)
+	return
+}